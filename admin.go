@@ -0,0 +1,92 @@
+package bots
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// AdminTokenHeader is the header carrying the token of the admin endpoints.
+const AdminTokenHeader = "X-Admin-Token"
+
+// requireAdmin checks the request carries ADMIN_TOKEN, in AdminTokenHeader or
+// in the token parameter, and replies with 403 otherwise.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	adminToken := os.Getenv("ADMIN_TOKEN")
+	token := r.Header.Get(AdminTokenHeader)
+	if token == "" {
+		token = r.FormValue("token")
+	}
+	if adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// adminDeleteHandler deletes the message of the story given by the id
+// parameter of a POST, e.g. a story flagged as spam. The story is kept as
+// Suppressed without its message, so the polls don't post it again until it's
+// cleaned up. The source and chat parameters default to Hacker News and
+// DefaultChatID.
+func adminDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	ctx := appengine.NewContext(r)
+
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid item id", http.StatusBadRequest)
+		return
+	}
+	source := r.FormValue("source")
+	if source == "" {
+		source = SourceHN
+	}
+	chatID := r.FormValue("chat")
+	if chatID == "" {
+		chatID = DefaultChatID
+	}
+
+	key := GetKey(ctx, source, chatID, id)
+	var messageID int64
+	err = datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		var story Story
+		if err := datastore.Get(ctx, key, &story); err != nil {
+			return errors.WithStack(err)
+		}
+		messageID = story.MessageID
+		story.Suppressed, story.MessageID = true, 0
+		_, err := datastore.Put(ctx, key, &story)
+		return errors.WithStack(err)
+	}, nil)
+	if errors.Cause(err) == datastore.ErrNoSuchEntity {
+		http.Error(w, "story not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		loge(ctx, err)
+		http.Error(w, "datastore error", http.StatusInternalServerError)
+		return
+	}
+
+	if messageID != 0 {
+		if err := deleteMessageFunc.Call(ctx, id, messageID, chatID, source); err != nil {
+			loge(ctx, errors.WithStack(err))
+			http.Error(w, "taskqueue error", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,70 @@
+package bots
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// configHandler returns the config of the chat of the chat parameter as JSON on
+// a GET, and replaces it by the JSON body of a PUT once validated. The fields
+// missing from the body take their default, and a PUT re-enables a Disabled
+// chat. The chat defaults to DefaultChatID.
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	ctx := appengine.NewContext(r)
+
+	chatID := r.URL.Query().Get("chat")
+	if chatID == "" {
+		chatID = DefaultChatID
+	}
+
+	var cfg *Config
+	switch r.Method {
+	case http.MethodGet:
+		var err error
+		if cfg, err = LoadConfig(ctx, chatID); err != nil {
+			loge(ctx, err)
+			http.Error(w, "datastore error", http.StatusInternalServerError)
+			return
+		}
+	case http.MethodPut:
+		cfg = DefaultConfig(chatID)
+		if err := json.NewDecoder(r.Body).Decode(cfg); err != nil {
+			http.Error(w, "invalid config: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if cfg.ChatID != chatID {
+			http.Error(w, "the ChatID of the config isn't the chat parameter", http.StatusBadRequest)
+			return
+		}
+		if err := cfg.Validate(); err != nil {
+			http.Error(w, "invalid config: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Saving the config re-enables the chat, even from the body of a
+		// GET of the disabled one.
+		cfg.Disabled, cfg.DisabledAt, cfg.DisabledReason = false, time.Time{}, ""
+		cfg.UpdatedAt = time.Now()
+		if _, err := datastore.Put(ctx, GetConfigKey(ctx, chatID), cfg); err != nil {
+			loge(ctx, errors.WithStack(err))
+			http.Error(w, "datastore error", http.StatusInternalServerError)
+			return
+		}
+		cfg.fillDefaults(ctx, chatID)
+	default:
+		http.Error(w, "GET or PUT only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(cfg); err != nil {
+		loge(ctx, errors.WithStack(err))
+	}
+}
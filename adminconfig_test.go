@@ -0,0 +1,54 @@
+package bots
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"google.golang.org/appengine"
+)
+
+func TestConfigHandlerReenables(t *testing.T) {
+	defer os.Setenv("ADMIN_TOKEN", os.Getenv("ADMIN_TOKEN"))
+	os.Setenv("ADMIN_TOKEN", "secret")
+	req, done := newTestRequest(t, http.MethodGet, "/admin/config?chat=@chat", nil)
+	defer done()
+	req.Header.Set(AdminTokenHeader, "secret")
+	ctx := appengine.NewContext(req)
+
+	if err := disableChat(ctx, "@chat", "Forbidden: bot was kicked"); err != nil {
+		t.Fatal(err)
+	}
+	// The body of the PUT is the config of the GET, still disabled.
+	w := httptest.NewRecorder()
+	configHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET status %d: %s", w.Code, w.Body)
+	}
+	var got Config
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if !got.Disabled {
+		t.Fatal("GET config not disabled")
+	}
+
+	// The request of the test instance is reused for the PUT.
+	req.Method, req.Body = http.MethodPut, ioutil.NopCloser(bytes.NewReader(w.Body.Bytes()))
+	w = httptest.NewRecorder()
+	configHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT status %d: %s", w.Code, w.Body)
+	}
+	cfg, err := LoadConfig(ctx, "@chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Disabled || !cfg.DisabledAt.IsZero() || cfg.DisabledReason != "" {
+		t.Errorf("config after a PUT = disabled %v at %v: %q, want enabled", cfg.Disabled, cfg.DisabledAt, cfg.DisabledReason)
+	}
+}
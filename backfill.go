@@ -0,0 +1,123 @@
+package bots
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// MaxBackfill is the max number of items a single backfill request accepts.
+const MaxBackfill = 500
+
+// parseItemIDs parses a comma separated list of item IDs and ranges of item
+// IDs, e.g. "1,5-8".
+func parseItemIDs(s string) ([]int64, error) {
+	var ids []int64
+	seen := make(IntSet)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		bounds := strings.SplitN(part, "-", 2)
+		from, err := strconv.ParseInt(bounds[0], 10, 64)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		to := from
+		if len(bounds) == 2 {
+			if to, err = strconv.ParseInt(bounds[1], 10, 64); err != nil {
+				return nil, errors.WithStack(err)
+			}
+		}
+		if to < from || to-from >= MaxBackfill {
+			return nil, fmt.Errorf("invalid range %q", part)
+		}
+		for id := from; id <= to; id++ {
+			if seen.Add(id) {
+				ids = append(ids, id)
+			}
+		}
+		if len(ids) > MaxBackfill {
+			return nil, fmt.Errorf("more than %d items", MaxBackfill)
+		}
+	}
+	return ids, nil
+}
+
+// backfillHandler schedules sending the Hacker News items in the ids parameter to every
+// configured chat, or only to the chat parameter when given. Items already
+// posted in a chat are skipped, and the usual thresholds apply. It responds
+// with a PollSummary counting the scheduled sends, with status 500 if some
+// failed to be scheduled.
+func backfillHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	ctx := appengine.NewContext(r)
+
+	ids, err := parseItemIDs(r.FormValue("ids"))
+	if err != nil || len(ids) == 0 {
+		http.Error(w, fmt.Sprintf("invalid ids: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	configs, err := LoadConfigs(ctx)
+	if err != nil {
+		loge(ctx, err)
+		http.Error(w, "datastore error", http.StatusInternalServerError)
+		return
+	}
+
+	var summary PollSummary
+	for _, cfg := range configs {
+		if chatID := r.FormValue("chat"); chatID != "" && chatID != cfg.ChatID {
+			continue
+		}
+
+		keys := make([]*datastore.Key, len(ids))
+		for i, id := range ids {
+			keys[i] = GetKey(ctx, SourceHN, cfg.ChatID, id)
+		}
+		savedStories := make([]Story, len(keys))
+		err := datastore.GetMulti(ctx, keys, savedStories)
+		multiErr, ok := err.(appengine.MultiError)
+		if err == nil {
+			continue
+		} else if !ok {
+			summary.addError(ctx, errors.Wrap(err, "in func backfillHandler() from datastore.GetMulti()"))
+			continue
+		}
+
+		var tasks []func()
+		for i, err := range multiErr {
+			if err != datastore.ErrNoSuchEntity {
+				continue
+			}
+			id, chatID := ids[i], cfg.ChatID
+			tasks = append(tasks, func() {
+				if err := sendMessageFunc.Call(ctx, id, chatID, Feed(""), SourceHN, int64(0), 1); err != nil {
+					summary.addEnqueueError(ctx, err)
+					return
+				}
+				atomic.AddInt64(&summary.Sends, 1)
+			})
+		}
+		summary.Skipped += int64(runBounded(ctx, MaxConcurrency, tasks))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if summary.Errors != 0 || summary.Skipped != 0 {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	if err := json.NewEncoder(w).Encode(&summary); err != nil {
+		loge(ctx, errors.WithStack(err))
+	}
+}
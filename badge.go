@@ -0,0 +1,43 @@
+package bots
+
+import "fmt"
+
+// BadgeRule shows Emoji in front of the score of the stories scoring at least
+// MinScore.
+type BadgeRule struct {
+	MinScore int64
+	Emoji    string
+}
+
+// DefaultBadgeRules is the default of Config.ScoreBadges.
+var DefaultBadgeRules = []BadgeRule{
+	{MinScore: 500, Emoji: "🔥"},
+	{MinScore: 200, Emoji: "⭐"},
+	{MinScore: 0, Emoji: "▲"},
+}
+
+// scoreBadge returns the emoji of the first of rules score reaches, or an empty
+// string if it reaches none. Rules are sorted by decreasing MinScore, see
+// validateBadgeRules.
+func scoreBadge(score int64, rules []BadgeRule) string {
+	for _, rule := range rules {
+		if score >= rule.MinScore {
+			return rule.Emoji
+		}
+	}
+	return ""
+}
+
+// validateBadgeRules returns an error unless rules are sorted by strictly
+// decreasing MinScore, so no two rules overlap, and all have an emoji.
+func validateBadgeRules(rules []BadgeRule) error {
+	for i, rule := range rules {
+		if rule.Emoji == "" {
+			return fmt.Errorf("badge rule %d has no emoji", i)
+		}
+		if i > 0 && rule.MinScore >= rules[i-1].MinScore {
+			return fmt.Errorf("badge rule %d with min score %d isn't below %d", i, rule.MinScore, rules[i-1].MinScore)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package bots
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// BatchEntry is a new story found by a poll of a chat with Config.BatchPost.
+type BatchEntry struct {
+	ID     int64
+	Feed   Feed
+	Source string
+	Rank   int64
+}
+
+func batchPost(ctx context.Context, chatID string, entries []BatchEntry) {
+	log.Infof(ctx, "posting %d stories to %s", len(entries), chatID)
+	fields := map[string]interface{}{"method": "batchPost", "chat_id": chatID, "stories": len(entries)}
+	cfg, err := LoadConfig(ctx, chatID)
+	if err != nil {
+		logeWith(ctx, err, fields)
+		return
+	}
+	if cfg.Disabled {
+		log.Infof(ctx, "chat %s is disabled, dropping %d stories", chatID, len(entries))
+		return
+	}
+	ctx = withDryRun(ctx, cfg.DryRun)
+	err = postCombined(ctx, cfg, entries)
+	if e, ok := asTelegramError(err); ok && e.IsChatGone() {
+		err = disableChat(ctx, chatID, e.Description)
+	}
+	if err != nil && !retryLater(ctx, err, batchPostFunc, chatID, entries) {
+		logeWith(ctx, err, fields)
+	}
+}
+
+// postCombined sends the stories of entries that may be posted in the chat of
+// cfg as a single numbered message, whose ID is saved in each of them with
+// Combined set. Combined stories are never edited, and the message isn't
+// deleted with them. A single story is sent as a message of its own.
+func postCombined(ctx context.Context, cfg *Config, entries []BatchEntry) error {
+	var stories []*Story
+	var keys []*datastore.Key
+	for _, e := range entries {
+		story := &Story{ID: e.ID, ChatID: cfg.ChatID, Feed: e.Feed, Source: e.Source, Rank: e.Rank}
+		if err := story.FillMissingFields(ctx); err != nil {
+			if !isIgnored(err) {
+				loge(ctx, err)
+			}
+			continue
+		}
+		// Stories over the posts per hour or in the quiet hours are left for
+		// a later poll.
+		if err := story.checkSendable(ctx, cfg); err != nil {
+			if !isIgnored(err) {
+				log.Infof(ctx, "skipping %d: %v", e.ID, err)
+			}
+			continue
+		}
+		key := GetKey(ctx, e.Source, cfg.ChatID, e.ID)
+		if err := claimStory(ctx, key, story); err != nil {
+			if errors.Cause(err) != errAlreadyClaimed {
+				loge(ctx, err)
+			}
+			continue
+		}
+		stories = append(stories, story)
+		keys = append(keys, key)
+	}
+	if len(stories) == 0 {
+		return nil
+	}
+
+	botID := chooseBot(ctx, stories[0].ID)
+	ctx = withBot(ctx, botID)
+	var err error
+	if len(stories) == 1 {
+		stories[0].BotID = botID
+		err = stories[0].SendMessage(ctx, cfg)
+	} else {
+		err = sendCombined(ctx, cfg, botID, stories)
+	}
+	if err != nil {
+		// Release the claims so the stories can be sent again later.
+		if err := datastore.DeleteMulti(ctx, keys); err != nil {
+			loge(ctx, errors.WithStack(err))
+		}
+		return err
+	}
+	countEvent(ctx, CounterPosted, int64(len(stories)))
+	if _, err := putMulti(ctx, keys, stories); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// sendCombined sends stories as a single numbered message, and updates them as
+// posted by it.
+func sendCombined(ctx context.Context, cfg *Config, botID int64, stories []*Story) error {
+	ordered := make([]Story, len(stories))
+	for i, story := range stories {
+		ordered[i] = *story
+	}
+	sortStories(ordered, cfg.DigestOrder)
+	var parts []string
+	var maxScore int64
+	for i := range ordered {
+		story := &ordered[i]
+		text, err := FormatStory(cfg, story)
+		if err != nil {
+			return err
+		}
+		parts = append(parts, fmt.Sprintf("%d\\. %s", i+1, text))
+		if story.Score > maxScore {
+			maxScore = story.Score
+		}
+	}
+	_, quiet := cfg.QuietUntil(time.Now())
+	messageID, err := postMessage(ctx, SendMessageRequest{
+		ChatID:                cfg.ChatID,
+		MessageThreadID:       cfg.MessageThreadID,
+		Text:                  truncateForTelegram(strings.Join(parts, "\n\n")),
+		ParseMode:             "MarkdownV2",
+		DisableWebPagePreview: cfg.DisablePreview,
+		DisableNotification:   cfg.IsSilent(maxScore) || quiet,
+	})
+	if err != nil {
+		return err
+	}
+	for _, story := range stories {
+		story.MessageID, story.Combined, story.BotID = messageID, true, botID
+		story.MessageThreadID = cfg.MessageThreadID
+		story.posted(cfg)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package bots
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+)
+
+// DefaultTopStoriesTTL is how long the top story lists are cached by the polls,
+// unless TOP_STORIES_TTL sets another duration.
+const DefaultTopStoriesTTL = 30 * time.Second
+
+// topStoriesTTLKey is the context key of withTopStoriesTTL.
+type topStoriesTTLKey struct{}
+
+// withTopStoriesTTL returns ctx whose top story lists are cached for ttl. They
+// aren't cached when ttl isn't positive.
+func withTopStoriesTTL(ctx context.Context, ttl time.Duration) context.Context {
+	return context.WithValue(ctx, topStoriesTTLKey{}, ttl)
+}
+
+// topStoriesTTL returns how long the top story lists of ctx are cached, zero
+// when they aren't.
+func topStoriesTTL(ctx context.Context) time.Duration {
+	ttl, _ := ctx.Value(topStoriesTTLKey{}).(time.Duration)
+	return ttl
+}
+
+// configuredTopStoriesTTL returns the TTL set by TOP_STORIES_TTL, e.g. "1m" or
+// "0" to disable the cache, or DefaultTopStoriesTTL.
+func configuredTopStoriesTTL(ctx context.Context) time.Duration {
+	s := os.Getenv("TOP_STORIES_TTL")
+	if s == "" {
+		return DefaultTopStoriesTTL
+	}
+	ttl, err := time.ParseDuration(s)
+	if err != nil {
+		log.Warningf(ctx, "invalid TOP_STORIES_TTL %q: %v", s, err)
+		return DefaultTopStoriesTTL
+	}
+	return ttl
+}
+
+// topStoriesCacheKey is the memcache key of the first limit stories of feed.
+func topStoriesCacheKey(feed Feed, limit int) string {
+	return fmt.Sprintf("TopStories/%s/%d", feed, limit)
+}
+
+// getTopStoriesCached is getTopStories whose result is cached in memcache for
+// ttl, so polls closer than ttl fetch the list only once. Memcache errors only
+// bypass the cache.
+func getTopStoriesCached(ctx context.Context, feed Feed, limit int, ttl time.Duration) ([]int64, error) {
+	if ttl <= 0 {
+		return getTopStories(ctx, feed, limit)
+	}
+
+	key := topStoriesCacheKey(feed, limit)
+	var ret []int64
+	_, err := memcache.JSON.Get(ctx, key, &ret)
+	if err == nil {
+		log.Debugf(ctx, "%s cached", key)
+		return ret, nil
+	}
+	if err != memcache.ErrCacheMiss {
+		log.Warningf(ctx, "getting %s from memcache: %v", key, err)
+	}
+
+	ret, err = getTopStories(ctx, feed, limit)
+	if err != nil {
+		return nil, err
+	}
+	if err := memcache.JSON.Set(ctx, &memcache.Item{Key: key, Object: ret, Expiration: ttl}); err != nil {
+		log.Warningf(ctx, "setting %s in memcache: %v", key, err)
+	}
+	return ret, nil
+}
+
+// SendGuardTTL is how long a send task keeps other tasks from sending the same
+// story, unless it releases the guard sooner.
+const SendGuardTTL = time.Minute
+
+// sendGuardKey is the memcache key of the guard of the send of the story of
+// the given ID of the given source to the given chat.
+func sendGuardKey(source, chatID string, id int64) string {
+	return fmt.Sprintf("sent:%s/%s/%d", source, chatID, id)
+}
+
+// acquireSendGuard returns false if another task is sending or just sent the
+// story of key. It's a cheap check before the claim of the story in datastore,
+// which remains the actual protection: it returns true when memcache fails.
+func acquireSendGuard(ctx context.Context, key string) bool {
+	err := memcache.Add(ctx, &memcache.Item{Key: key, Value: []byte{1}, Expiration: SendGuardTTL})
+	if err == memcache.ErrNotStored {
+		return false
+	}
+	if err != nil {
+		log.Warningf(ctx, "adding %s to memcache: %v", key, err)
+	}
+	return true
+}
+
+// releaseSendGuard releases the guard of key, so a failed send may be retried
+// right away.
+func releaseSendGuard(ctx context.Context, key string) {
+	if err := memcache.Delete(ctx, key); err != nil && err != memcache.ErrCacheMiss {
+		log.Warningf(ctx, "deleting %s from memcache: %v", key, err)
+	}
+}
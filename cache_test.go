@@ -0,0 +1,64 @@
+package bots
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSendGuard(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	key, other := sendGuardKey(SourceHN, "@chat", 1), sendGuardKey(SourceHN, "@other", 1)
+	for _, c := range []struct {
+		name string
+		do   func() bool
+		want bool
+	}{
+		{"first", func() bool { return acquireSendGuard(ctx, key) }, true},
+		{"duplicate", func() bool { return acquireSendGuard(ctx, key) }, false},
+		{"other chat", func() bool { return acquireSendGuard(ctx, other) }, true},
+		{"released", func() bool { releaseSendGuard(ctx, key); return acquireSendGuard(ctx, key) }, true},
+		{"released twice", func() bool { releaseSendGuard(ctx, key); releaseSendGuard(ctx, key); return acquireSendGuard(ctx, key) }, true},
+	} {
+		if got := c.do(); got != c.want {
+			t.Errorf("%s: acquireSendGuard() = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestSendMessageGuard(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	var fail int32 = 1
+	server := newFakeServer(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host == "hacker-news.firebaseio.com" {
+			io.WriteString(w, `{"id":1,"type":"story","title":"A story","url":"https://example.com/","score":1000,"descendants":100}`)
+			return
+		}
+		if atomic.LoadInt32(&fail) == 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"ok":false,"error_code":400,"description":"Bad Request: can't parse entities"}`)
+			return
+		}
+		io.WriteString(w, `{"ok":true,"result":{"message_id":42}}`)
+	})
+	defer server.Close()
+
+	// A failed send releases its guard, so it can be retried right away.
+	sendMessage(ctx, 1, DefaultChatID, FeedTop, SourceHN, 1, SendMaxAttempts)
+	atomic.StoreInt32(&fail, 0)
+	sendMessage(ctx, 1, DefaultChatID, FeedTop, SourceHN, 1, 1)
+	if got := len(server.TelegramRequests()); got != 2 {
+		t.Fatalf("%d Telegram requests, want 2", got)
+	}
+	// A sent story keeps it, duplicate tasks bail before datastore.
+	if acquireSendGuard(ctx, sendGuardKey(SourceHN, DefaultChatID, 1)) {
+		t.Errorf("guard of a sent story acquired")
+	}
+	sendMessage(ctx, 1, DefaultChatID, FeedTop, SourceHN, 1, 1)
+	if got := len(server.TelegramRequests()); got != 2 {
+		t.Errorf("%d Telegram requests after a duplicate send, want 2", got)
+	}
+}
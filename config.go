@@ -0,0 +1,565 @@
+package bots
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// DefaultRetentionHours is the default of Config.RetentionHours.
+const DefaultRetentionHours = 24
+
+// Config is the per-channel configuration stored in datastore, keyed by chat ID.
+type Config struct {
+	// ChatID is either the @username of a channel or the numeric ID of a
+	// chat, e.g. -1001234567890 for a supergroup. Both are sent as is, as a
+	// string, which Telegram accepts for either form.
+	ChatID      string
+	MinScore    int64
+	MinComments int64
+	// Sources is the names of the sources polled for stories.
+	Sources []string
+	// Feeds is the Hacker News feeds polled for stories.
+	Feeds []Feed
+	// Subreddits is the subreddits whose top posts are polled when Sources
+	// has reddit, without the r/ prefix.
+	Subreddits []string
+	// PostJobs is whether job posts are posted.
+	PostJobs bool
+	// DisablePreview is whether the link previews of the messages are disabled.
+	DisablePreview bool
+	// ShowDomain is whether the domain of the link of a story is shown after
+	// its title, like on Hacker News.
+	ShowDomain bool
+	// ShowSelfPostDomain is whether the self-posts show the domain of their
+	// comments page with ShowDomain, e.g. news.ycombinator.com.
+	ShowSelfPostDomain bool
+	// FallbackChatID is the chat the stories are posted in when the bot may
+	// no longer post in this chat, e.g. it was kicked. The stories stay
+	// tracked by this chat. Empty drops them.
+	FallbackChatID string
+	// OpsChatID is the chat alerted of the errors of the delay tasks of this
+	// chat. Empty alerts the chat of OPS_CHAT_ID, if set.
+	OpsChatID string
+	// MessageThreadID is the topic the stories are posted in, when the chat
+	// is a forum supergroup. Zero posts them in the chat itself.
+	MessageThreadID int64
+	// PinTop is whether the message of the #1 story of the top feed is pinned.
+	PinTop bool
+	// PinDigest is whether a pinned message lists the current top stories of
+	// the top feed, updated by each poll.
+	PinDigest bool
+	// DomainBlacklist is the list of domains whose stories are never posted.
+	// Subdomains of a blacklisted domain are blacklisted too.
+	DomainBlacklist []string
+	// RetentionHours is how long a story stays in the chat after it was last
+	// polled. Zero or negative values keep the stories forever.
+	RetentionHours int64
+	// NotifyFallOff is whether a note is posted in reply to the message of a
+	// story before it's deleted by the cleanup.
+	NotifyFallOff bool
+	// ResurfaceAfterHours is how long after a posted story left the feeds of
+	// the chat it's posted again if it re-enters them, see ResurfaceAfter.
+	// Zero keeps it posted once until its cleanup.
+	ResurfaceAfterHours int64
+	// DigestChatID is the chat receiving the daily digest of the stories
+	// posted in this chat. No digest is sent when it's empty.
+	DigestChatID string
+	// DigestOrder is the order of the entries of the digests and combined
+	// posts, one of the DigestOrder constants. The daily digest lists the
+	// highest scores first, the others follow their feed, when it's empty.
+	DigestOrder string
+	// MessageTemplate is the text/template laying out the messages of the
+	// stories, see DefaultTemplate. DefaultTemplate is used when it's empty or
+	// invalid.
+	MessageTemplate string `datastore:",noindex"`
+	// MaxScoreSamples is the number of score samples kept per story. Zero or
+	// negative values disable the samples.
+	MaxScoreSamples int64
+	// DryRun is whether the Telegram requests of the chat are logged instead
+	// of sent. Datastore is still updated as if they were sent.
+	DryRun bool
+	// KeywordAllowlist is the list of terms whose stories are posted whatever
+	// their score and comments. Terms match whole words of the titles,
+	// ignoring case.
+	KeywordAllowlist []string
+	// MinTitleLen is the number of characters below which the titles are
+	// junk, e.g. empty titles of glitched items. Zero accepts any title.
+	MinTitleLen int64
+	// TitleBlockRegex is the regexp of the junk titles, never posted. An
+	// invalid regexp is ignored.
+	TitleBlockRegex string
+	// CommentMilestones is the numbers of comments whose crossing is notified
+	// by a reply to the message of the story.
+	CommentMilestones []int64
+	// ReactOnMilestone is whether the crossing of the ScoreMilestones is
+	// celebrated by a MilestoneReaction on the message of the story.
+	ReactOnMilestone bool
+	// ScoreMilestones is the scores whose crossing is celebrated with
+	// ReactOnMilestone.
+	ScoreMilestones []int64
+	// DedupeByURL is whether stories linking an article posted in the chat in
+	// the last DedupeWindow are skipped.
+	DedupeByURL bool
+	// UsePhotoWhenImage is whether stories linking an article with an
+	// OpenGraph image are sent as photos, with the text as caption.
+	UsePhotoWhenImage bool
+	// SilentBelowScore is the score below which stories are posted without
+	// notifying the members of the chat. Zero notifies all of them.
+	SilentBelowScore int64
+	// EditDebounceSeconds is how long after an edit of a story is scheduled
+	// no other edit of it is. Zero schedules an edit on every poll.
+	EditDebounceSeconds int64
+	// EditCooldownSeconds is how long after a story is posted its message is
+	// first edited, since its score barely moved. Zero edits it right away.
+	EditCooldownSeconds int64
+	// MaxEdits is the number of edits after which the message of a story is
+	// frozen. Zero edits it for as long as it's polled.
+	MaxEdits int64
+	// MinAgeMinutes is how long after their submission stories are posted,
+	// so stories only trending briefly are skipped.
+	MinAgeMinutes int64
+	// MaxRank is the lowest position in their feed of the stories posted,
+	// e.g. 10 only posts the stories reaching the top 10. Zero posts stories
+	// at any position.
+	MaxRank int64
+	// MaxPostsPerHour is the most stories posted in the chat in a rolling
+	// hour. The sends over it are deferred, lowest scores last. Zero posts
+	// stories as they come.
+	MaxPostsPerHour int64
+	// ScoreBadges is the emojis shown in front of the scores, see BadgeRule.
+	// They must be sorted by decreasing MinScore.
+	ScoreBadges []BadgeRule
+	// BatchPost is whether the new stories found by a poll are posted as a
+	// single numbered message. Such combined posts are never edited.
+	BatchPost bool
+	// QuietStart and QuietEnd are the hours, in Timezone, between which new
+	// stories are posted without notification, see QuietUntil.
+	QuietStart int64
+	QuietEnd   int64
+	// Timezone is the IANA name of the zone of the quiet hours, UTC when
+	// empty.
+	Timezone string
+	// QuietDefer is whether the new stories are posted after the quiet
+	// hours instead of silently during them.
+	QuietDefer bool
+	// HighScoreFastTrack is the score from which stories are posted whatever
+	// their number of comments, e.g. rising stories not discussed yet. Zero
+	// always requires MinComments.
+	HighScoreFastTrack int64
+	// MinHotness is the hotness, see hotness, below which new stories aren't
+	// posted, so young rising stories are preferred to stale high-score ones.
+	// Zero posts stories whatever their hotness.
+	MinHotness float64
+	// Gravity is how fast the hotness of the stories decays with their age,
+	// DefaultGravity when zero or negative.
+	Gravity float64
+	// UpdatedAt is when the config was last saved by /admin/config.
+	UpdatedAt time.Time
+	// Disabled is whether the chat is skipped by the polls, set when the bot
+	// may no longer post in it, see disableChat. Saving the config with
+	// /admin/config re-enables it.
+	Disabled       bool
+	DisabledAt     time.Time
+	DisabledReason string
+
+	domainBlacklist StringSet
+	keywords        *regexp.Regexp
+	titleBlock      *regexp.Regexp
+	location        *time.Location
+}
+
+// DefaultConfig returns the config used when no entity exists for the chat.
+func DefaultConfig(chatID string) *Config {
+	return &Config{
+		ChatID:      chatID,
+		MinScore:    ScoreThreshold,
+		MinComments: NumCommentsThreshold,
+		Sources:     []string{SourceHN},
+		Feeds:       []Feed{FeedTop},
+
+		RetentionHours:    DefaultRetentionHours,
+		MaxScoreSamples:   DefaultMaxScoreSamples,
+		CommentMilestones: DefaultCommentMilestones,
+		ScoreMilestones:   DefaultScoreMilestones,
+		ScoreBadges:       DefaultBadgeRules,
+		Gravity:           DefaultGravity,
+	}
+}
+
+// GetConfigKey get a datastore key for the config of the given chat ID.
+func GetConfigKey(ctx context.Context, chatID string) *datastore.Key {
+	return datastore.NewKey(ctx, "Config", chatID, 0, nil)
+}
+
+// emptyConfig returns a DefaultConfig ready to be loaded from datastore.
+// Multi-valued properties are appended on load, so they start empty.
+func emptyConfig(chatID string) *Config {
+	cfg := DefaultConfig(chatID)
+	cfg.Sources = nil
+	cfg.Feeds = nil
+	cfg.Subreddits = nil
+	cfg.DomainBlacklist = nil
+	cfg.KeywordAllowlist = nil
+	cfg.CommentMilestones = nil
+	cfg.ScoreMilestones = nil
+	cfg.ScoreBadges = nil
+	return cfg
+}
+
+// fillDefaults restores the defaults of the fields left empty or invalid after
+// loading, and prepares the lookups derived from the loaded fields.
+func (c *Config) fillDefaults(ctx context.Context, chatID string) {
+	c.ChatID = chatID
+	if !isValidChatID(chatID) {
+		log.Warningf(ctx, "chat ID %q is neither a @username nor a numeric ID", chatID)
+	}
+	if c.MessageTemplate != "" {
+		if err := validateTemplate(c.MessageTemplate); err != nil {
+			log.Warningf(ctx, "invalid message template of %s: %v", chatID, err)
+			c.MessageTemplate = ""
+		}
+	}
+	if len(c.Sources) == 0 {
+		c.Sources = DefaultConfig(chatID).Sources
+	}
+	if len(c.Feeds) == 0 {
+		c.Feeds = DefaultConfig(chatID).Feeds
+	}
+	if len(c.CommentMilestones) == 0 {
+		c.CommentMilestones = DefaultCommentMilestones
+	}
+	if len(c.ScoreMilestones) == 0 {
+		c.ScoreMilestones = DefaultScoreMilestones
+	}
+	if err := validateBadgeRules(c.ScoreBadges); err != nil {
+		log.Warningf(ctx, "invalid score badges of %s: %v", chatID, err)
+		c.ScoreBadges = nil
+	}
+	if len(c.ScoreBadges) == 0 {
+		c.ScoreBadges = DefaultBadgeRules
+	}
+	c.domainBlacklist = make(StringSet)
+	for _, domain := range c.DomainBlacklist {
+		c.domainBlacklist.Add(strings.ToLower(domain))
+	}
+	if !isValidDigestOrder(c.DigestOrder) {
+		log.Warningf(ctx, "invalid digest order of %s: %q", chatID, c.DigestOrder)
+		c.DigestOrder = ""
+	}
+	c.keywords = keywordsRegexp(c.KeywordAllowlist)
+	c.titleBlock = nil
+	if c.TitleBlockRegex != "" {
+		re, err := regexp.Compile(c.TitleBlockRegex)
+		if err != nil {
+			log.Warningf(ctx, "invalid title block regexp of %s: %v", chatID, err)
+		} else {
+			c.titleBlock = re
+		}
+	}
+	if !isValidHour(c.QuietStart) || !isValidHour(c.QuietEnd) {
+		log.Warningf(ctx, "invalid quiet hours of %s: %d to %d", chatID, c.QuietStart, c.QuietEnd)
+		c.QuietStart, c.QuietEnd = 0, 0
+	}
+	if c.Gravity <= 0 {
+		c.Gravity = DefaultGravity
+	}
+	c.location = time.UTC
+	if c.Timezone != "" {
+		loc, err := time.LoadLocation(c.Timezone)
+		if err != nil {
+			log.Warningf(ctx, "invalid timezone of %s: %v", chatID, err)
+		} else {
+			c.location = loc
+		}
+	}
+}
+
+// keywordsRegexp returns the regexp matching any of terms as whole words,
+// ignoring case, or nil when there is no term. Words are delimited by non-word
+// characters so terms like "C++" work too.
+func keywordsRegexp(terms []string) *regexp.Regexp {
+	var quoted []string
+	for _, term := range terms {
+		if term = strings.TrimSpace(term); term != "" {
+			quoted = append(quoted, regexp.QuoteMeta(term))
+		}
+	}
+	if len(quoted) == 0 {
+		return nil
+	}
+	return regexp.MustCompile(`(?i)(?:^|\W)(?:` + strings.Join(quoted, "|") + `)(?:\W|$)`)
+}
+
+// chatIDRegexp matches the chat IDs Telegram accepts: the @username of a
+// channel, or the numeric ID of a chat, negative for groups.
+var chatIDRegexp = regexp.MustCompile(`^(@[A-Za-z][A-Za-z0-9_]{3,}|-?[0-9]+)$`)
+
+// Validate returns an error if the config makes no sense, e.g. a negative
+// threshold, an unknown feed or an invalid regexp. Loaded configs are repaired
+// by fillDefaults instead, Validate rejects them before they're saved.
+func (c *Config) Validate() error {
+	for _, chatID := range []string{c.ChatID, c.DigestChatID, c.FallbackChatID, c.OpsChatID} {
+		if chatID != "" && !isValidChatID(chatID) {
+			return errors.Errorf("invalid chat ID %q", chatID)
+		}
+	}
+	for _, field := range []struct {
+		name  string
+		value int64
+	}{
+		{"MinScore", c.MinScore},
+		{"MinComments", c.MinComments},
+		{"MaxRank", c.MaxRank},
+		{"MaxPostsPerHour", c.MaxPostsPerHour},
+		{"MinTitleLen", c.MinTitleLen},
+		{"MessageThreadID", c.MessageThreadID},
+	} {
+		if field.value < 0 {
+			return errors.Errorf("negative %s %d", field.name, field.value)
+		}
+	}
+	if c.MinHotness < 0 {
+		return errors.Errorf("negative MinHotness %v", c.MinHotness)
+	}
+	for _, name := range c.Sources {
+		if _, err := NewSource(name, ""); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	for _, feed := range c.Feeds {
+		if !isValidFeed(feed) {
+			return errors.Errorf("unknown feed %q", feed)
+		}
+	}
+	for _, subreddit := range c.Subreddits {
+		if !subredditRegexp.MatchString(subreddit) {
+			return errors.Errorf("invalid subreddit %q", subreddit)
+		}
+	}
+	if c.MessageTemplate != "" {
+		if err := validateTemplate(c.MessageTemplate); err != nil {
+			return err
+		}
+	}
+	if err := validateBadgeRules(c.ScoreBadges); err != nil {
+		return err
+	}
+	if _, err := regexp.Compile(c.TitleBlockRegex); err != nil {
+		return errors.WithStack(err)
+	}
+	if !isValidHour(c.QuietStart) || !isValidHour(c.QuietEnd) {
+		return errors.Errorf("invalid quiet hours %d to %d", c.QuietStart, c.QuietEnd)
+	}
+	if _, err := time.LoadLocation(c.Timezone); err != nil {
+		return errors.WithStack(err)
+	}
+	if !isValidDigestOrder(c.DigestOrder) {
+		return errors.Errorf("unknown digest order %q", c.DigestOrder)
+	}
+	return nil
+}
+
+// subredditRegexp matches the names of the subreddits.
+var subredditRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_]{1,20}$`)
+
+// isValidChatID returns true if chatID is a @username or a numeric ID.
+func isValidChatID(chatID string) bool {
+	return chatIDRegexp.MatchString(chatID)
+}
+
+// PolledSources returns the sources polled for stories, with a source for each
+// Hacker News feed and subreddit.
+func (c *Config) PolledSources() ([]Source, error) {
+	var sources []Source
+	for _, name := range c.Sources {
+		if name == SourceHN {
+			for _, feed := range c.Feeds {
+				sources = append(sources, hnSource{feed: feed})
+			}
+			continue
+		}
+		if name == SourceReddit {
+			for _, subreddit := range c.Subreddits {
+				sources = append(sources, redditSource{subreddit: subreddit})
+			}
+			continue
+		}
+		src, err := NewSource(name, "")
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		sources = append(sources, src)
+	}
+	return sources, nil
+}
+
+// Retention returns how long a story stays in the chat after it was last
+// polled, or false if stories are never deleted.
+func (c *Config) Retention() (time.Duration, bool) {
+	if c.RetentionHours <= 0 {
+		return 0, false
+	}
+	return time.Duration(c.RetentionHours) * time.Hour, true
+}
+
+// IsBlacklisted returns true when host, or a domain it's a subdomain of, is
+// in the domain blacklist.
+func (c *Config) IsBlacklisted(host string) bool {
+	for host != "" {
+		if c.domainBlacklist.Contains(host) {
+			return true
+		}
+		i := strings.Index(host, ".")
+		if i < 0 {
+			break
+		}
+		host = host[i+1:]
+	}
+	return false
+}
+
+// EditDebounce returns how long after an edit of a story is scheduled no other
+// edit of it is, or false if edits aren't debounced.
+func (c *Config) EditDebounce() (time.Duration, bool) {
+	if c.EditDebounceSeconds <= 0 {
+		return 0, false
+	}
+	return time.Duration(c.EditDebounceSeconds) * time.Second, true
+}
+
+// ResurfaceAfter returns how long after a posted story left the feeds of the
+// chat it's posted again if it re-enters them, or false if it isn't. A story
+// re-entering sooner keeps its message. A resurfacing story has its message
+// deleted, and the next poll posts it as a new story.
+func (c *Config) ResurfaceAfter() (time.Duration, bool) {
+	if c.ResurfaceAfterHours <= 0 {
+		return 0, false
+	}
+	return time.Duration(c.ResurfaceAfterHours) * time.Hour, true
+}
+
+// EditCooldown returns how long after a story is posted its message is first
+// edited, or false if it may be edited right away.
+func (c *Config) EditCooldown() (time.Duration, bool) {
+	if c.EditCooldownSeconds <= 0 {
+		return 0, false
+	}
+	return time.Duration(c.EditCooldownSeconds) * time.Second, true
+}
+
+// MinAge returns how long after their submission stories are posted, or false
+// if they are posted right away.
+func (c *Config) MinAge() (time.Duration, bool) {
+	if c.MinAgeMinutes <= 0 {
+		return 0, false
+	}
+	return time.Duration(c.MinAgeMinutes) * time.Minute, true
+}
+
+// IsFastTracked returns true if stories of the given score are posted without
+// MinComments.
+func (c *Config) IsFastTracked(score int64) bool {
+	return c.HighScoreFastTrack > 0 && score >= c.HighScoreFastTrack
+}
+
+// IsSilent returns true when a story of the given score is posted without
+// notification.
+func (c *Config) IsSilent(score int64) bool {
+	return score < c.SilentBelowScore
+}
+
+// IsJunkTitle returns true when title, without its surrounding spaces, is
+// shorter than MinTitleLen or matches TitleBlockRegex.
+func (c *Config) IsJunkTitle(title string) bool {
+	title = strings.TrimSpace(title)
+	if int64(utf8.RuneCountInString(title)) < c.MinTitleLen {
+		return true
+	}
+	return c.titleBlock != nil && c.titleBlock.MatchString(title)
+}
+
+// IsAllowlisted returns true when title contains a term of the keyword
+// allowlist.
+func (c *Config) IsAllowlisted(title string) bool {
+	return c.keywords != nil && c.keywords.MatchString(title)
+}
+
+// LoadConfig loads the config of the given chat from datastore, falling back to
+// DefaultConfig when no entity exists.
+func LoadConfig(ctx context.Context, chatID string) (*Config, error) {
+	cfg := emptyConfig(chatID)
+	err := datastore.Get(ctx, GetConfigKey(ctx, chatID), cfg)
+	if err == datastore.ErrNoSuchEntity {
+		return DefaultConfig(chatID), nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	cfg.fillDefaults(ctx, chatID)
+	return cfg, nil
+}
+
+// disableChat marks the chat as Disabled for the given reason, unless it
+// already is. The transition is logged once.
+func disableChat(ctx context.Context, chatID, reason string) error {
+	key := GetConfigKey(ctx, chatID)
+	var disabled bool
+	err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		// The transaction may be retried.
+		disabled = false
+		cfg := emptyConfig(chatID)
+		err := datastore.Get(ctx, key, cfg)
+		if err == datastore.ErrNoSuchEntity {
+			cfg = DefaultConfig(chatID)
+		} else if err != nil {
+			return errors.WithStack(err)
+		}
+		if cfg.Disabled {
+			return nil
+		}
+		cfg.Disabled, cfg.DisabledAt, cfg.DisabledReason = true, time.Now(), reason
+		if _, err := datastore.Put(ctx, key, cfg); err != nil {
+			return errors.WithStack(err)
+		}
+		disabled = true
+		return nil
+	}, nil)
+	if err != nil {
+		return err
+	}
+	if disabled {
+		log.Warningf(ctx, "disabled chat %s: %s", chatID, reason)
+	}
+	return nil
+}
+
+// LoadConfigs loads the configs of all the chats the stories are posted to.
+// When no chat is configured, only DefaultChatID is used.
+func LoadConfigs(ctx context.Context) ([]*Config, error) {
+	keys, err := datastore.NewQuery("Config").KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(keys) == 0 {
+		return []*Config{DefaultConfig(DefaultChatID)}, nil
+	}
+
+	configs := make([]*Config, len(keys))
+	for i, key := range keys {
+		configs[i] = emptyConfig(key.StringID())
+	}
+	if err := datastore.GetMulti(ctx, keys, configs); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for i, key := range keys {
+		configs[i].fillDefaults(ctx, key.StringID())
+	}
+	return configs, nil
+}
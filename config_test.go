@@ -0,0 +1,194 @@
+package bots
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIsAllowlisted(t *testing.T) {
+	cfg := &Config{MinScore: 100, MinComments: 10, keywords: keywordsRegexp([]string{"Go", "C++", " rust ", "", "a.b"})}
+	for _, c := range []struct {
+		title string
+		want  bool
+	}{
+		{"Go 1.9 is released", true},
+		{"Why I stopped using go", true},
+		{"(Go) generics", true},
+		{"Going places", false},
+		{"Algol and Gopher", false},
+		{"C++17 is here", false},
+		{"Modern C++ tips", true},
+		{"C++: the good parts", true},
+		{"Rust vs. C", true},
+		{"Trusted types", false},
+		{"aXb isn't a.b", true},
+		{"aXb", false},
+		{"Nothing to see", false},
+	} {
+		if got := cfg.IsAllowlisted(c.title); got != c.want {
+			t.Errorf("IsAllowlisted(%q) = %v, want %v", c.title, got, c.want)
+		}
+		// Allowlisted stories skip the thresholds.
+		s := &Story{Type: "story", Title: c.title, Score: 1}
+		if got := s.IgnoreReason(cfg) == ""; got != c.want {
+			t.Errorf("IgnoreReason() of %q = %q, want it ignored %v", c.title, s.IgnoreReason(cfg), !c.want)
+		}
+	}
+	if (&Config{}).IsAllowlisted("Go") {
+		t.Errorf("IsAllowlisted() without keywords = true")
+	}
+}
+
+func TestIsValidChatID(t *testing.T) {
+	for _, c := range []struct {
+		chatID string
+		want   bool
+	}{
+		{"@yahnc", true},
+		{"@a_b_c1", true},
+		{"-1001234567890", true},
+		{"-123456789", true},
+		{"123456789", true},
+		{"yahnc", false},
+		{"@ab", false},
+		{"@1abc", false},
+		{"@-100123", false},
+		{"-100 123", false},
+		{"", false},
+	} {
+		if got := isValidChatID(c.chatID); got != c.want {
+			t.Errorf("isValidChatID(%q) = %v, want %v", c.chatID, got, c.want)
+		}
+	}
+}
+
+func TestFastTrack(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		fastTrack int64
+		score     int64
+		comments  int64
+		want      string
+	}{
+		{"disabled", 0, 1000, 0, IgnoreComments},
+		{"below", 300, 299, 0, IgnoreComments},
+		{"at", 300, 300, 0, ""},
+		{"above", 300, 500, 2, ""},
+		{"enough comments", 300, 150, 10, ""},
+		// The score threshold still applies.
+		{"below the min score", 50, 80, 0, IgnoreScore},
+	} {
+		cfg := &Config{MinScore: 100, MinComments: 10, HighScoreFastTrack: c.fastTrack}
+		s := &Story{Type: "story", Title: "A story", Score: c.score, Descendants: c.comments}
+		if got := s.IgnoreReason(cfg); got != c.want {
+			t.Errorf("%s: IgnoreReason() = %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestIsJunkTitle(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	for _, c := range []struct {
+		name       string
+		minLen     int64
+		blockRegex string
+		title      string
+		want       bool
+	}{
+		{"no filter", 0, "", "", false},
+		{"short", 10, "", "Too short", true},
+		{"long enough", 10, "", "Long enough", false},
+		{"spaces", 10, "", "   short   ", true},
+		// Characters are counted, not bytes.
+		{"runes", 5, "", "日本語です", false},
+		{"blocked", 0, `(?i)^\[?(dupe|flagged)\]?`, "[Flagged] A story", true},
+		{"not blocked", 0, `(?i)^\[?(dupe|flagged)\]?`, "A flagged story", false},
+		{"invalid regexp", 0, `(`, "(", false},
+	} {
+		cfg := &Config{MinTitleLen: c.minLen, TitleBlockRegex: c.blockRegex}
+		cfg.fillDefaults(ctx, "@chat")
+		if got := cfg.IsJunkTitle(c.title); got != c.want {
+			t.Errorf("%s: IsJunkTitle(%q) = %v, want %v", c.name, c.title, got, c.want)
+		}
+		s := &Story{Type: "story", Title: c.title, Score: 100, Descendants: 100}
+		reason, err := s.sendBlockReason(ctx, cfg, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := reason == IgnoreTitle; got != c.want {
+			t.Errorf("%s: sendBlockReason(%q) = %q, want it junk %v", c.name, c.title, reason, c.want)
+		}
+	}
+}
+
+func TestDisableChat(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	var calls int32
+	server := newFakeServer(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host == "hacker-news.firebaseio.com" {
+			io.WriteString(w, `{"id":1,"type":"story","title":"A story","url":"https://example.com/","score":1000,"descendants":100}`)
+			return
+		}
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"ok":false,"error_code":400,"description":"Bad Request: chat not found"}`)
+	})
+	defer server.Close()
+
+	// A send to a chat gone disables it.
+	sendMessage(ctx, 1, "@gone", FeedTop, SourceHN, 1, 1)
+	cfg, err := LoadConfig(ctx, "@gone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.Disabled || cfg.DisabledReason != "Bad Request: chat not found" || cfg.DisabledAt.IsZero() {
+		t.Fatalf("config after a chat not found = disabled %v at %v: %q", cfg.Disabled, cfg.DisabledAt, cfg.DisabledReason)
+	}
+	// The defaults are kept.
+	if cfg.MinScore != ScoreThreshold {
+		t.Errorf("MinScore of the disabled chat = %d, want %d", cfg.MinScore, ScoreThreshold)
+	}
+
+	// Only the first transition is recorded.
+	disabledAt := cfg.DisabledAt
+	if err := disableChat(ctx, "@gone", "Forbidden: bot was kicked from the channel chat"); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err = LoadConfig(ctx, "@gone"); err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.DisabledAt.Equal(disabledAt) || cfg.DisabledReason != "Bad Request: chat not found" {
+		t.Errorf("config disabled again at %v: %q, want %v", cfg.DisabledAt, cfg.DisabledReason, disabledAt)
+	}
+
+	// The sends to the disabled chat are dropped.
+	sendMessage(ctx, 2, "@gone", FeedTop, SourceHN, 1, 1)
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("%d Telegram requests, want 1", n)
+	}
+}
+
+func TestIsChatGone(t *testing.T) {
+	for _, c := range []struct {
+		code        int64
+		description string
+		want        bool
+	}{
+		{400, "Bad Request: chat not found", true},
+		{403, "Forbidden: bot was kicked from the channel chat", true},
+		{403, "Forbidden: bot is not a member of the channel chat", true},
+		{400, "Bad Request: message to edit not found", false},
+		{400, "Bad Request: message not found", false},
+		{429, "Too Many Requests: retry after 5", false},
+	} {
+		e := &TelegramError{Method: "sendMessage", Code: c.code, Description: c.description}
+		if got := e.IsChatGone(); got != c.want {
+			t.Errorf("IsChatGone() of %d %q = %v, want %v", c.code, c.description, got, c.want)
+		}
+	}
+}
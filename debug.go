@@ -0,0 +1,81 @@
+package bots
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/appengine"
+)
+
+// DebugItem is the response of the /debug/item/ endpoint.
+type DebugItem struct {
+	Story  *Story `json:"story"`
+	ChatID string `json:"chat_id"`
+	Kind   string `json:"kind"`
+	// IgnoredBy is the filter the story fails, see sendBlockReason, empty
+	// when it would be posted.
+	IgnoredBy string `json:"ignored_by,omitempty"`
+}
+
+// debugItemHandler fetches the item of /debug/item/<id> and reports whether
+// it passes the filters of SendMessage, without posting it. The source and
+// chat parameters default to Hacker News and DefaultChatID.
+func debugItemHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	ctx := appengine.NewContext(r)
+
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/debug/item/"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid item id", http.StatusBadRequest)
+		return
+	}
+	source := r.FormValue("source")
+	if source == "" {
+		source = SourceHN
+	}
+	chatID := r.FormValue("chat")
+	if chatID == "" {
+		chatID = DefaultChatID
+	}
+
+	cfg, err := LoadConfig(ctx, chatID)
+	if err != nil {
+		loge(ctx, err)
+		http.Error(w, "datastore error", http.StatusInternalServerError)
+		return
+	}
+	story := Story{ID: id, ChatID: chatID, Source: source}
+	if err := story.FillMissingFields(ctx); err != nil {
+		if errors.Cause(err) == ErrItemDeleted {
+			http.Error(w, "item not found", http.StatusNotFound)
+			return
+		}
+		loge(ctx, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	reason, err := story.sendBlockReason(ctx, cfg, time.Now())
+	if err != nil {
+		loge(ctx, err)
+		http.Error(w, "datastore error", http.StatusInternalServerError)
+		return
+	}
+	debug := DebugItem{
+		Story:     &story,
+		ChatID:    chatID,
+		Kind:      story.Kind(),
+		IgnoredBy: reason,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(debug); err != nil {
+		loge(ctx, errors.WithStack(err))
+	}
+}
@@ -0,0 +1,91 @@
+package bots
+
+import (
+	"context"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/appengine/datastore"
+)
+
+// DedupeWindow is how long an article posted in a chat keeps other
+// submissions of it from being posted, see Config.DedupeByURL.
+const DedupeWindow = 48 * time.Hour
+
+// maxIndexedLen is the max length in bytes of an indexed datastore string.
+const maxIndexedLen = 1500
+
+// trackingParams are the query parameters dropped by normalizeURL, in addition
+// to the utm_ ones.
+var trackingParams = StringSet{
+	"fbclid": {},
+	"gclid":  {},
+	"mc_cid": {},
+	"mc_eid": {},
+	"ref":    {},
+	"source": {},
+}
+
+// normalizeURL returns u without what differs between submissions of the same
+// article: the scheme, a www. prefix, the trailing slash, the fragment and the
+// tracking parameters. Unparsable URLs are returned as is. It's indexed, so
+// it's truncated to maxIndexedLen.
+func normalizeURL(u string) string {
+	parsed, err := url.Parse(strings.TrimSpace(u))
+	if err != nil || parsed.Host == "" {
+		if len(u) > maxIndexedLen {
+			return u[:maxIndexedLen]
+		}
+		return u
+	}
+	host := strings.TrimPrefix(strings.ToLower(parsed.Host), "www.")
+
+	query := parsed.Query()
+	for param := range query {
+		if strings.HasPrefix(param, "utm_") || trackingParams.Contains(param) {
+			query.Del(param)
+		}
+	}
+	var params []string
+	for param := range query {
+		params = append(params, param)
+	}
+	sort.Strings(params)
+	var pairs []string
+	for _, param := range params {
+		for _, value := range query[param] {
+			pairs = append(pairs, url.QueryEscape(param)+"="+url.QueryEscape(value))
+		}
+	}
+
+	norm := host + strings.TrimRight(parsed.EscapedPath(), "/")
+	if len(pairs) != 0 {
+		norm += "?" + strings.Join(pairs, "&")
+	}
+	if len(norm) > maxIndexedLen {
+		norm = norm[:maxIndexedLen]
+	}
+	return norm
+}
+
+// isDuplicate returns true if another story linking the same article as s was
+// posted in its chat within DedupeWindow, from any source.
+func (s *Story) isDuplicate(ctx context.Context) (bool, error) {
+	norm := normalizeURL(s.URL)
+	// Only NormURL is filtered on by the query so it needs no composite index.
+	var stories []Story
+	if _, err := datastore.NewQuery("Story").Filter("NormURL =", norm).GetAll(ctx, &stories); err != nil {
+		return false, errors.WithStack(err)
+	}
+	since := time.Now().Add(-DedupeWindow)
+	for _, story := range stories {
+		same := story.ID == s.ID && story.Source == s.Source
+		if !same && story.ChatID == s.ChatID && story.MessageID != 0 && story.PostedAt.After(since) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
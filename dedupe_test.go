@@ -0,0 +1,65 @@
+package bots
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizeURL(t *testing.T) {
+	for _, c := range []struct {
+		url, want string
+	}{
+		{"https://example.com/a", "example.com/a"},
+		{"http://www.Example.COM/a/", "example.com/a"},
+		{"https://example.com/a#section", "example.com/a"},
+		{"https://example.com/a?utm_source=hn&utm_medium=x", "example.com/a"},
+		{"https://example.com/a?b=2&a=1&fbclid=x&ref=hn", "example.com/a?a=1&b=2"},
+		{"https://example.com/", "example.com"},
+		{"  https://example.com/a  ", "example.com/a"},
+		{"https://example.com/a%20b", "example.com/a%20b"},
+		{"not a url", "not a url"},
+		{"", ""},
+		{"https://example.com/" + strings.Repeat("a", 2000), "example.com/" + strings.Repeat("a", maxIndexedLen-len("example.com/"))},
+	} {
+		if got := normalizeURL(c.url); got != c.want {
+			t.Errorf("normalizeURL(%q) = %q, want %q", c.url, got, c.want)
+		}
+	}
+}
+
+func TestIsDuplicate(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	now := time.Now()
+	for _, s := range []Story{
+		{ID: 1, ChatID: "@chat", Source: SourceHN, URL: "https://example.com/posted", MessageID: 42, PostedAt: now.Add(-time.Hour)},
+		{ID: 2, ChatID: "@chat", Source: SourceHN, URL: "https://example.com/old", MessageID: 43, PostedAt: now.Add(-DedupeWindow - time.Hour)},
+		{ID: 3, ChatID: "@chat", Source: SourceHN, URL: "https://example.com/claimed"},
+		{ID: 4, ChatID: "@other", Source: SourceHN, URL: "https://example.com/other", MessageID: 44, PostedAt: now.Add(-time.Hour)},
+	} {
+		s := s
+		putStory(ctx, t, GetKey(ctx, s.Source, s.ChatID, s.ID), &s, now)
+	}
+	for _, c := range []struct {
+		name  string
+		story Story
+		want  bool
+	}{
+		{"posted", Story{ID: 10, ChatID: "@chat", Source: SourceHN, URL: "http://www.example.com/posted/?utm_source=x"}, true},
+		{"other source", Story{ID: 1, ChatID: "@chat", Source: SourceLobsters, URL: "https://example.com/posted"}, true},
+		{"itself", Story{ID: 1, ChatID: "@chat", Source: SourceHN, URL: "https://example.com/posted"}, false},
+		{"past the window", Story{ID: 10, ChatID: "@chat", Source: SourceHN, URL: "https://example.com/old"}, false},
+		{"not sent yet", Story{ID: 10, ChatID: "@chat", Source: SourceHN, URL: "https://example.com/claimed"}, false},
+		{"other chat", Story{ID: 10, ChatID: "@chat", Source: SourceHN, URL: "https://example.com/other"}, false},
+		{"new", Story{ID: 10, ChatID: "@chat", Source: SourceHN, URL: "https://example.com/new"}, false},
+	} {
+		got, err := c.story.isDuplicate(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Errorf("%s: isDuplicate() = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package bots
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// DigestSize is the number of stories in a daily digest.
+const DigestSize = 10
+
+// errDigestSent is returned when the digest of the day was already sent.
+var errDigestSent = errors.New("digest already sent")
+
+// DigestSent marks the digest of a chat as sent for the day.
+type DigestSent struct {
+	MessageID int64
+	SentAt    time.Time
+}
+
+// GetDigestSentKey get a datastore key for the digest of the given chat, sent
+// on the given date.
+func GetDigestSentKey(ctx context.Context, chatID, date string) *datastore.Key {
+	return datastore.NewKey(ctx, "DigestSent", date, 0, GetConfigKey(ctx, chatID))
+}
+
+func digestHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	configs, err := LoadConfigs(ctx)
+	if err != nil {
+		loge(ctx, err)
+		return
+	}
+
+	now := time.Now()
+	var stories []Story
+	_, err = datastore.NewQuery("Story").Filter("LastSave >=", now.Add(-24*time.Hour)).GetAll(ctx, &stories)
+	if err != nil {
+		loge(ctx, err)
+		return
+	}
+
+	for _, cfg := range configs {
+		if cfg.DigestChatID == "" {
+			continue
+		}
+		if err := sendDigest(withDryRun(ctx, cfg.DryRun), cfg, stories, now); err != nil {
+			if errors.Cause(err) == errDigestSent {
+				log.Infof(ctx, "digest of %s already sent today", cfg.ChatID)
+				continue
+			}
+			loge(ctx, err)
+		}
+	}
+}
+
+// sendDigest sends the digest of the stories posted in the chat of cfg, at
+// most once per day.
+func sendDigest(ctx context.Context, cfg *Config, stories []Story, now time.Time) error {
+	var top []Story
+	for _, story := range stories {
+		if story.ChatID == cfg.ChatID && story.MessageID != 0 {
+			top = append(top, story)
+		}
+	}
+	if len(top) == 0 {
+		return nil
+	}
+	sort.Slice(top, func(i, j int) bool {
+		return top[i].Score > top[j].Score
+	})
+	if len(top) > DigestSize {
+		top = top[:DigestSize]
+	}
+	sortStories(top, cfg.DigestOrder)
+
+	// Mark the digest as sent before sending it, so a concurrent trigger bails.
+	key := GetDigestSentKey(ctx, cfg.ChatID, now.UTC().Format("2006-01-02"))
+	err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		var sent DigestSent
+		err := datastore.Get(ctx, key, &sent)
+		if err == nil {
+			return errDigestSent
+		}
+		if err != datastore.ErrNoSuchEntity {
+			return errors.WithStack(err)
+		}
+		_, err = datastore.Put(ctx, key, &DigestSent{SentAt: now})
+		return errors.WithStack(err)
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	messageID, err := postMessage(ctx, SendMessageRequest{
+		ChatID:    cfg.DigestChatID,
+		Text:      FormatDigest(top, now),
+		ParseMode: "MarkdownV2",
+	})
+	if err != nil {
+		// Let the next trigger of the day try again.
+		if err := datastore.Delete(ctx, key); err != nil {
+			loge(ctx, err)
+		}
+		return errors.WithStack(err)
+	}
+
+	if _, err := datastore.Put(ctx, key, &DigestSent{MessageID: messageID, SentAt: now}); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// FormatDigest returns the MarkdownV2 text of a digest listing stories in order.
+func FormatDigest(stories []Story, now time.Time) string {
+	return formatDigest("Top stories of the day", stories, now)
+}
+
+// formatDigest returns the MarkdownV2 text of a digest under the given header,
+// listing stories in order.
+func formatDigest(header string, stories []Story, now time.Time) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%s*\n", escapeMarkdownV2(header))
+	for i, s := range stories {
+		fmt.Fprintf(&buf, "\n%d\\. [%s](%s) \\(%d points, [%d comments](%s)",
+			i+1, escapeMarkdownV2(s.Title), escapeMarkdownV2URL(s.Link()),
+			s.Score, s.Descendants, escapeMarkdownV2URL(s.CommentsLink()))
+		if ago := s.PostedAgo(now); ago != "" {
+			fmt.Fprintf(&buf, ", posted %s", escapeMarkdownV2(ago))
+		}
+		buf.WriteString("\\)")
+	}
+	return buf.String()
+}
@@ -0,0 +1,53 @@
+package bots
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFormatDigest(t *testing.T) {
+	now := time.Date(2017, time.October, 10, 12, 0, 0, 0, time.UTC)
+	stories := []Story{
+		{ID: 1, Title: "First", URL: "https://example.com/1", Score: 300, Descendants: 30, PostedAt: now.Add(-5 * time.Hour)},
+		{ID: 2, Title: "Second v1.0", Score: 200, Descendants: 20, PostedAt: now.Add(-10 * time.Minute)},
+		{ID: 3, Title: "Third", URL: "https://example.com/3", Score: 100, Descendants: 10},
+	}
+	want := "*Top stories of the day*\n" +
+		"\n1\\. [First](https://example.com/1) \\(300 points, [30 comments](https://news.ycombinator.com/item?id=1), posted 5 hours ago\\)" +
+		"\n2\\. [Second v1\\.0](https://news.ycombinator.com/item?id=2) \\(200 points, [20 comments](https://news.ycombinator.com/item?id=2), posted 10 minutes ago\\)" +
+		"\n3\\. [Third](https://example.com/3) \\(100 points, [10 comments](https://news.ycombinator.com/item?id=3)\\)"
+	if got := FormatDigest(stories, now); got != want {
+		t.Errorf("FormatDigest() = %q, want %q", got, want)
+	}
+}
+
+func TestSendDigestNow(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	server := newFakeServer(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"ok":true,"result":{"message_id":42}}`)
+	})
+	defer server.Close()
+
+	// The digest is formatted at the time of its DigestSent marker.
+	now := time.Now().Add(-3 * time.Hour)
+	cfg := &Config{ChatID: "@chat", DigestChatID: "@chat"}
+	stories := []Story{{ID: 1, ChatID: "@chat", MessageID: 41, Title: "A story", Score: 100, PostedAt: now.Add(-2 * time.Hour)}}
+	if err := sendDigest(ctx, cfg, stories, now); err != nil {
+		t.Fatal(err)
+	}
+	reqs := server.TelegramRequests()
+	if len(reqs) != 1 {
+		t.Fatalf("%d Telegram requests, want 1", len(reqs))
+	}
+	var req SendMessageRequest
+	if err := json.Unmarshal(reqs[0].Body, &req); err != nil {
+		t.Fatal(err)
+	}
+	if want := FormatDigest(stories, now); req.Text != want {
+		t.Errorf("digest %q, want %q", req.Text, want)
+	}
+}
@@ -0,0 +1,60 @@
+package bots
+
+import "github.com/pkg/errors"
+
+// Errors refining ErrIgnoredItem, so callers may tell why a story is skipped.
+// isIgnored is true for all of them.
+var (
+	// ErrItemDeleted is returned for the items deleted, killed or purged by
+	// their source.
+	ErrItemDeleted = errors.New("item deleted")
+	// ErrBelowThreshold is returned for the stories failing the score,
+	// comments or rank thresholds of the chat.
+	ErrBelowThreshold = errors.New("item below threshold")
+	// ErrNotModified is returned by EditMessage when the message already
+	// shows the story.
+	ErrNotModified = errors.New("message not modified")
+)
+
+// ErrRateLimited is the cause of every RateLimitError, see asRateLimitError
+// for the delay it requests.
+var ErrRateLimited = errors.New("rate limited")
+
+// isIgnored returns true if err means the story is skipped rather than failed,
+// i.e. its cause is ErrIgnoredItem or one of the errors refining it.
+func isIgnored(err error) bool {
+	switch errors.Cause(err) {
+	case ErrIgnoredItem, ErrItemDeleted, ErrBelowThreshold, ErrNotModified:
+		return true
+	}
+	return false
+}
+
+// ignoreError returns the error of the given reason of IgnoreReason.
+func ignoreError(reason string) error {
+	switch reason {
+	case IgnoreDeleted:
+		return ErrItemDeleted
+	case IgnoreScore, IgnoreComments, IgnoreRank, IgnoreHotness:
+		return ErrBelowThreshold
+	}
+	return ErrIgnoredItem
+}
+
+// asRateLimitError returns the RateLimitError err wraps, if any. errors.Cause
+// can't, since it returns ErrRateLimited.
+func asRateLimitError(err error) (*RateLimitError, bool) {
+	for err != nil {
+		if e, ok := err.(*RateLimitError); ok {
+			return e, true
+		}
+		c, ok := err.(interface {
+			Cause() error
+		})
+		if !ok {
+			break
+		}
+		err = c.Cause()
+	}
+	return nil, false
+}
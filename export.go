@@ -0,0 +1,72 @@
+package bots
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// ExportBatchSize is the number of stories read by each query of /export.
+const ExportBatchSize = 500
+
+// exportHandler streams all the saved stories as newline-delimited JSON
+// objects, with all their saved properties and their encoded key. The stories
+// are read in batches, continuing from the cursor of the previous batch, so
+// they are never all in memory.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	ctx := appengine.NewContext(r)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	var cursor *datastore.Cursor
+	for {
+		q := datastore.NewQuery("Story").Limit(ExportBatchSize)
+		if cursor != nil {
+			q = q.Start(*cursor)
+		}
+		it := q.Run(ctx)
+		n := 0
+		for {
+			var props datastore.PropertyList
+			key, err := it.Next(&props)
+			if err == datastore.Done {
+				break
+			}
+			if err != nil {
+				// The response is already partly sent, the export ends
+				// early.
+				loge(ctx, errors.WithStack(err))
+				return
+			}
+			n++
+
+			record := map[string]interface{}{"key": key.Encode()}
+			for _, p := range props {
+				record[p.Name] = p.Value
+			}
+			if err := enc.Encode(record); err != nil {
+				loge(ctx, errors.WithStack(err))
+				return
+			}
+		}
+		if n < ExportBatchSize {
+			return
+		}
+
+		next, err := it.Cursor()
+		if err != nil {
+			loge(ctx, errors.WithStack(err))
+			return
+		}
+		cursor = &next
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package bots
+
+import "fmt"
+
+// Feed is a story list of a Source.
+type Feed string
+
+// Hacker News feeds that can be polled.
+const (
+	FeedTop  Feed = "top"
+	FeedBest Feed = "best"
+	FeedNew  Feed = "new"
+	FeedAsk  Feed = "ask"
+	FeedShow Feed = "show"
+	FeedJob  Feed = "job"
+)
+
+// isValidFeed returns true if feed is one of the Hacker News feeds.
+func isValidFeed(feed Feed) bool {
+	switch feed {
+	case FeedTop, FeedBest, FeedNew, FeedAsk, FeedShow, FeedJob:
+		return true
+	}
+	return false
+}
+
+// FeedURL is a helper function to get the API of the given feed, limited to the
+// first limit stories.
+func FeedURL(feed Feed, limit int) string {
+	return fmt.Sprintf(`https://hacker-news.firebaseio.com/v0/%sstories.json?orderBy="$key"&limitToFirst=%d`, feed, limit)
+}
@@ -0,0 +1,86 @@
+package bots
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// HealthTimeout is the timeout of the dependency checks of /healthz.
+const HealthTimeout = 5 * time.Second
+
+// HealthCheckURL is the Hacker News API checked by /healthz.
+const HealthCheckURL = `https://hacker-news.firebaseio.com/v0/maxitem.json`
+
+// Health is the response of the /healthz endpoint.
+type Health struct {
+	OK           bool                        `json:"ok"`
+	Dependencies map[string]DependencyHealth `json:"dependencies"`
+}
+
+// DependencyHealth is the status of a dependency in Health.
+type DependencyHealth struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(appengine.NewContext(r), HealthTimeout)
+	defer cancel()
+
+	health := Health{OK: true, Dependencies: make(map[string]DependencyHealth)}
+	for name, check := range map[string]func(context.Context) error{
+		"hacker_news": checkHackerNews,
+		"datastore":   checkDatastore,
+	} {
+		dep := DependencyHealth{OK: true}
+		if err := check(ctx); err != nil {
+			loge(ctx, err)
+			dep = DependencyHealth{Error: err.Error()}
+			health.OK = false
+		}
+		health.Dependencies[name] = dep
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !health.OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(health); err != nil {
+		loge(ctx, errors.WithStack(err))
+	}
+}
+
+func checkHackerNews(ctx context.Context) error {
+	req, err := newRequest(http.MethodHead, HealthCheckURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := newHTTPClient(ctx).Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return errors.WithStack(fmt.Errorf("HEAD %s: %s", HealthCheckURL, resp.Status))
+	}
+	return nil
+}
+
+func checkDatastore(ctx context.Context) error {
+	var cfg Config
+	err := datastore.Get(ctx, GetConfigKey(ctx, DefaultChatID), &cfg)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return errors.WithStack(err)
+	}
+	return nil
+}
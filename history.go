@@ -0,0 +1,70 @@
+package bots
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/appengine/datastore"
+)
+
+// DefaultMaxScoreSamples is the default of Config.MaxScoreSamples.
+const DefaultMaxScoreSamples = 48
+
+// ScoreSample is the score and number of comments of a story at some time. A
+// sample is saved, as a child of the story, on every edit of its message.
+type ScoreSample struct {
+	Time     time.Time
+	Score    int64
+	Comments int64
+}
+
+// GetScoreSampleKey get a datastore key for the sample of the story of the
+// given key taken at the given time. Samples sort by time in key order.
+func GetScoreSampleKey(ctx context.Context, storyKey *datastore.Key, t time.Time) *datastore.Key {
+	return datastore.NewKey(ctx, "ScoreSample", "", t.UnixNano(), storyKey)
+}
+
+// newScoreSample returns a sample of story and its key, to be saved by the
+// caller, and deletes the oldest samples so at most max are kept once it is.
+// No sample is returned when max isn't positive. It must run in a transaction
+// on the entity group of the story.
+func newScoreSample(ctx context.Context, storyKey *datastore.Key, story *Story, max int64) (*datastore.Key, *ScoreSample, error) {
+	if max <= 0 {
+		return nil, nil, nil
+	}
+	// Ancestor queries return the samples in key order, which is time order.
+	keys, err := datastore.NewQuery("ScoreSample").Ancestor(storyKey).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	if n := int64(len(keys)) - max + 1; n > 0 {
+		if err := datastore.DeleteMulti(ctx, keys[:n]); err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+	}
+
+	now := time.Now()
+	sample := &ScoreSample{Time: now, Score: story.Score, Comments: story.Descendants}
+	return GetScoreSampleKey(ctx, storyKey, now), sample, nil
+}
+
+// deleteScoreSamples deletes all the samples of the story of the given key.
+func deleteScoreSamples(ctx context.Context, storyKey *datastore.Key) error {
+	keys, err := datastore.NewQuery("ScoreSample").Ancestor(storyKey).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(datastore.DeleteMulti(ctx, keys))
+}
+
+// StoryHistory returns the samples of the story of the given ID of the given
+// source, posted in the given chat, oldest first.
+func StoryHistory(ctx context.Context, source, chatID string, id int64) ([]ScoreSample, error) {
+	var samples []ScoreSample
+	_, err := datastore.NewQuery("ScoreSample").Ancestor(GetKey(ctx, source, chatID, id)).GetAll(ctx, &samples)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return samples, nil
+}
@@ -0,0 +1,55 @@
+package bots
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+)
+
+func TestUpdateStoryPutMulti(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	var calls [][]*datastore.Key
+	defer func(prev func(context.Context, []*datastore.Key, interface{}) ([]*datastore.Key, error)) {
+		putMulti = prev
+	}(putMulti)
+	putMulti = func(ctx context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+		calls = append(calls, keys)
+		return datastore.PutMulti(ctx, keys, src)
+	}
+
+	key := GetKey(ctx, SourceHN, DefaultChatID, 1)
+	putStory(ctx, t, key, &Story{ID: 1, MessageID: 42}, time.Now())
+	for _, c := range []struct {
+		maxSamples int64
+		// puts is the number of entities expected in the single PutMulti.
+		puts    int
+		samples int
+	}{
+		{3, 2, 1},
+		{3, 2, 2},
+		{3, 2, 3},
+		{3, 2, 3},
+		{2, 2, 2},
+		// Without samples only the story is saved.
+		{0, 1, 2},
+	} {
+		calls = nil
+		story := &Story{ID: 1, MessageID: 42, Score: 100}
+		if err := updateStory(ctx, key, story, c.maxSamples); err != nil {
+			t.Fatal(err)
+		}
+		if len(calls) != 1 || len(calls[0]) != c.puts {
+			t.Errorf("updateStory() with %d samples saved %v, want one PutMulti of %d entities", c.maxSamples, calls, c.puts)
+		}
+		samples, err := StoryHistory(ctx, SourceHN, DefaultChatID, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(samples) != c.samples {
+			t.Errorf("updateStory() with %d samples kept %d, want %d", c.maxSamples, len(samples), c.samples)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package bots
+
+import (
+	"math"
+	"time"
+)
+
+// DefaultGravity is the gravity of the hotness when Config.Gravity isn't set,
+// the one of the Hacker News ranking.
+const DefaultGravity = 1.8
+
+// hotness returns the hotness of a story of the given score submitted ageHours
+// ago, score / (ageHours + 2)^gravity like the Hacker News ranking. The higher
+// the gravity, the faster stories cool down.
+func hotness(score int, ageHours float64, gravity float64) float64 {
+	if ageHours < 0 {
+		ageHours = 0
+	}
+	return float64(score) / math.Pow(ageHours+2, gravity)
+}
+
+// Hotness returns the hotness of the story at now with the gravity of cfg, or
+// false when its submission time is unknown.
+func (s *Story) Hotness(cfg *Config, now time.Time) (float64, bool) {
+	if s.HNTime.IsZero() {
+		return 0, false
+	}
+	return hotness(int(s.Score), now.Sub(s.HNTime).Hours(), cfg.Gravity), true
+}
+
+// isCold returns true if the story is below the MinHotness of cfg at now, and
+// its hotness. Jobs, stories of unknown age and allowlisted stories are never
+// cold.
+func (s *Story) isCold(cfg *Config, now time.Time) (float64, bool) {
+	if cfg.MinHotness <= 0 || s.Kind() == KindJob || cfg.IsAllowlisted(s.Title) {
+		return 0, false
+	}
+	h, ok := s.Hotness(cfg, now)
+	return h, ok && h < cfg.MinHotness
+}
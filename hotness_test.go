@@ -0,0 +1,53 @@
+package bots
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestHotness(t *testing.T) {
+	for _, c := range []struct {
+		score    int
+		ageHours float64
+		gravity  float64
+		want     float64
+	}{
+		{100, 0, 1.8, 100 / math.Pow(2, 1.8)},
+		{100, 2, 1.8, 100 / math.Pow(4, 1.8)},
+		{100, 2, 1, 25},
+		{500, 22, 1, 500.0 / 24},
+		{100, -1, 1, 50},
+		{0, 5, 1.8, 0},
+	} {
+		if got := hotness(c.score, c.ageHours, c.gravity); math.Abs(got-c.want) > 1e-9 {
+			t.Errorf("hotness(%d, %v, %v) = %v, want %v", c.score, c.ageHours, c.gravity, got, c.want)
+		}
+	}
+	// A young rising story is hotter than an older one of a higher score.
+	if young, old := hotness(50, 1, DefaultGravity), hotness(300, 24, DefaultGravity); young <= old {
+		t.Errorf("hotness of a young story %v, want above %v", young, old)
+	}
+}
+
+func TestIsCold(t *testing.T) {
+	now := time.Now()
+	for _, c := range []struct {
+		name       string
+		minHotness float64
+		story      Story
+		want       bool
+	}{
+		{"no threshold", 0, Story{Type: "story", Score: 1, HNTime: now.Add(-48 * time.Hour)}, false},
+		{"hot", 5, Story{Type: "story", Score: 100, HNTime: now.Add(-time.Hour)}, false},
+		{"stale", 5, Story{Type: "story", Score: 300, HNTime: now.Add(-48 * time.Hour)}, true},
+		{"unknown age", 5, Story{Type: "story", Score: 1}, false},
+		{"job", 5, Story{Type: "job", HNTime: now.Add(-48 * time.Hour)}, false},
+		{"allowlisted", 5, Story{Type: "story", Title: "Go 2", Score: 1, HNTime: now.Add(-48 * time.Hour)}, false},
+	} {
+		cfg := &Config{MinHotness: c.minHotness, Gravity: DefaultGravity, keywords: keywordsRegexp([]string{"go"})}
+		if _, got := c.story.isCold(cfg, now); got != c.want {
+			t.Errorf("%s: isCold() = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package bots
+
+import (
+	"bytes"
+	"html"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// SelfTextLength is the max number of characters of the self-text shown in the
+// message of an Ask HN story.
+const SelfTextLength = 500
+
+// Ellipsis ends truncated texts.
+const Ellipsis = "…"
+
+// htmlTagRegexp matches the tags of the HTML of HN texts.
+var htmlTagRegexp = regexp.MustCompile(`<(/?)([a-zA-Z]+)([^>]*)>`)
+
+// htmlHrefRegexp matches the href attribute of a link.
+var htmlHrefRegexp = regexp.MustCompile(`href="([^"]*)"`)
+
+// markdownV2CodeReplacer escapes the characters reserved inside MarkdownV2 code.
+var markdownV2CodeReplacer = strings.NewReplacer("`", "\\`", `\`, `\\`)
+
+// htmlToTelegram converts the limited HTML of HN texts to MarkdownV2. See
+// htmlToTelegramLimit.
+func htmlToTelegram(s string) string {
+	return htmlToTelegramLimit(s, -1)
+}
+
+// htmlToTelegramLimit converts the limited HTML of HN texts, paragraphs, links,
+// italics and code, to MarkdownV2. Other tags are dropped. When max isn't
+// negative the text is truncated to max characters, not counting the markup,
+// with an ellipsis.
+func htmlToTelegramLimit(s string, max int) string {
+	var buf bytes.Buffer
+	var href string
+	inItalic, inCode, inPre := false, false, false
+	left := max
+
+	// write writes the text between tags, and returns false once the text
+	// is truncated.
+	write := func(text string) bool {
+		text = html.UnescapeString(text)
+		truncated := false
+		if max >= 0 && utf8.RuneCountInString(text) > left {
+			text, truncated = truncateGraphemes(text, left), true
+		}
+		left -= utf8.RuneCountInString(text)
+		if inCode || inPre {
+			buf.WriteString(markdownV2CodeReplacer.Replace(text))
+		} else {
+			buf.WriteString(escapeMarkdownV2(text))
+		}
+		if truncated {
+			buf.WriteString(Ellipsis)
+		}
+		return !truncated
+	}
+
+	// closeAll closes the entities still open once truncated.
+	closeAll := func() {
+		if inPre {
+			buf.WriteString("\n```")
+		} else if inCode {
+			buf.WriteString("`")
+		}
+		if inItalic {
+			buf.WriteString("_")
+		}
+		if href != "" {
+			buf.WriteString("](" + escapeMarkdownV2URL(href) + ")")
+		}
+	}
+
+	for s != "" {
+		loc := htmlTagRegexp.FindStringSubmatchIndex(s)
+		if loc == nil {
+			if !write(s) {
+				closeAll()
+			}
+			break
+		}
+		if !write(s[:loc[0]]) {
+			closeAll()
+			break
+		}
+		closing := loc[3] > loc[2]
+		tag, attrs := strings.ToLower(s[loc[4]:loc[5]]), s[loc[6]:loc[7]]
+		s = s[loc[1]:]
+
+		switch {
+		case tag == "p" && !closing:
+			buf.WriteString("\n\n")
+		case tag == "i" && !inCode && !inPre && inItalic == closing:
+			inItalic = !closing
+			buf.WriteString("_")
+		case tag == "pre":
+			inPre = !closing
+			if closing {
+				buf.WriteString("\n```")
+			} else {
+				buf.WriteString("```\n")
+			}
+		case tag == "code" && !inPre:
+			inCode = !closing
+			buf.WriteString("`")
+		case tag == "a" && !closing:
+			if m := htmlHrefRegexp.FindStringSubmatch(attrs); m != nil {
+				href = html.UnescapeString(m[1])
+				buf.WriteString("[")
+			}
+		case tag == "a" && href != "":
+			buf.WriteString("](" + escapeMarkdownV2URL(href) + ")")
+			href = ""
+		}
+	}
+	return strings.TrimSpace(buf.String())
+}
+
+// zeroWidthJoiner joins emojis into a single grapheme.
+const zeroWidthJoiner = '\u200d'
+
+// isGraphemeExtend returns true if r extends the grapheme of the rune before
+// it, e.g. a combining mark.
+func isGraphemeExtend(r rune) bool {
+	return unicode.In(r, unicode.Mn, unicode.Me, unicode.Variation_Selector) || r == zeroWidthJoiner
+}
+
+// truncateGraphemes returns the first max runes of s or less, without cutting a
+// rune from the marks and joiners extending it.
+func truncateGraphemes(s string, max int) string {
+	i, n := 0, 0
+	for i < len(s) && n < max {
+		_, size := utf8.DecodeRuneInString(s[i:])
+		i += size
+		n++
+	}
+	if i == len(s) {
+		return s
+	}
+	// Back off to the start of the grapheme cut at i.
+	for i > 0 {
+		next, _ := utf8.DecodeRuneInString(s[i:])
+		last, size := utf8.DecodeLastRuneInString(s[:i])
+		if !isGraphemeExtend(next) && last != zeroWidthJoiner {
+			break
+		}
+		i -= size
+	}
+	return s[:i]
+}
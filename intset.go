@@ -14,6 +14,12 @@ func (set IntSet) Add(i int64) bool {
 	return true
 }
 
+// Contains returns true if the number is in the set.
+func (set IntSet) Contains(i int64) bool {
+	_, ok := set[i]
+	return ok
+}
+
 // AddAll add a slice of ints to the set.
 func (set IntSet) AddAll(xs []int64) {
 	for _, i := range xs {
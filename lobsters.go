@@ -0,0 +1,146 @@
+package bots
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/appengine/log"
+)
+
+// LobstersHottestURL is the API of the hottest stories on Lobsters.
+const LobstersHottestURL = `https://lobste.rs/hottest.json`
+
+// FeedLobstersHottest is the feed of the hottest stories on Lobsters.
+const FeedLobstersHottest Feed = "hottest"
+
+// lobstersStory is a story as returned by the Lobsters API.
+type lobstersStory struct {
+	ShortID      string `json:"short_id"`
+	Title        string `json:"title"`
+	URL          string `json:"url"`
+	Score        int64  `json:"score"`
+	CommentCount int64  `json:"comment_count"`
+	CommentsURL  string `json:"comments_url"`
+}
+
+// lobstersSource is the hottest stories on Lobsters. Lobsters identifies
+// stories with base 36 short IDs, they are converted to int64 IDs.
+type lobstersSource struct{}
+
+// LobstersShortIDLength is the length of the short IDs of Lobsters. The int64
+// IDs lose their leading zeros, which are restored by padding them to it.
+const LobstersShortIDLength = 6
+
+// lobstersShortID returns the short ID of the Lobsters story of the given ID.
+func lobstersShortID(id int64) string {
+	shortID := strconv.FormatInt(id, 36)
+	if n := LobstersShortIDLength - len(shortID); n > 0 {
+		shortID = strings.Repeat("0", n) + shortID
+	}
+	return shortID
+}
+
+// LobstersItemURL is a helper function to get the API of a Lobsters story.
+func LobstersItemURL(id int64) string {
+	return `https://lobste.rs/s/` + lobstersShortID(id) + `.json`
+}
+
+// lobstersGet fetches url and decodes its JSON into v. Network errors and 5xx
+// responses are retried like the top story lists of Hacker News, malformed
+// responses aren't. ErrItemDeleted is returned for a 404.
+func lobstersGet(ctx context.Context, url string, v interface{}) error {
+	backoff := TopStoriesRetryBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := fetchLobsters(ctx, url, v)
+		if err == nil || !retry || attempt > TopStoriesRetries {
+			return err
+		}
+		log.Warningf(ctx, "retrying %s in %v: %v", url, backoff, err)
+		select {
+		case <-ctx.Done():
+			return errors.WithStack(ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// fetchLobsters fetches url once for lobstersGet, and returns whether a failed
+// fetch may be retried.
+func fetchLobsters(ctx context.Context, url string, v interface{}) (bool, error) {
+	resp, err := httpGet(ctx, url)
+	if err != nil {
+		return true, errors.Wrapf(err, "in fetchLobsters() fetching %s", url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		io.Copy(ioutil.Discard, resp.Body)
+		return false, errors.WithStack(ErrItemDeleted)
+	}
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		err := errors.Errorf("in fetchLobsters() fetching %s: %s", url, resp.Status)
+		return resp.StatusCode >= http.StatusInternalServerError, err
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return false, errors.Wrapf(err, "in fetchLobsters() decoding %s", url)
+	}
+	return false, nil
+}
+
+func (lobstersSource) Name() string {
+	return SourceLobsters
+}
+
+func (lobstersSource) Feed() Feed {
+	return FeedLobstersHottest
+}
+
+func (lobstersSource) TopItems(ctx context.Context, limit int) ([]int64, error) {
+	var stories []lobstersStory
+	if err := lobstersGet(ctx, LobstersHottestURL, &stories); err != nil {
+		return nil, err
+	}
+
+	var ret []int64
+	for _, story := range stories {
+		id, err := strconv.ParseInt(story.ShortID, 36, 64)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		// Its item couldn't be fetched, e.g. a longer short ID with a
+		// leading zero.
+		if lobstersShortID(id) != story.ShortID {
+			log.Warningf(ctx, "skipping Lobsters story of unexpected short ID %q", story.ShortID)
+			continue
+		}
+		ret = append(ret, id)
+		if len(ret) == limit {
+			break
+		}
+	}
+	return ret, nil
+}
+
+func (lobstersSource) Item(ctx context.Context, id int64) (*Item, error) {
+	var story lobstersStory
+	if err := lobstersGet(ctx, LobstersItemURL(id), &story); err != nil {
+		return nil, err
+	}
+	return &Item{
+		ID:          id,
+		Type:        "story",
+		Title:       story.Title,
+		URL:         story.URL,
+		Score:       &story.Score,
+		Descendants: &story.CommentCount,
+		CommentsURL: story.CommentsURL,
+	}, nil
+}
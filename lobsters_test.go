@@ -0,0 +1,90 @@
+package bots
+
+import (
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestLobstersShortID(t *testing.T) {
+	for _, shortID := range []string{"abcdef", "0abcde", "00000z", "000000", "zzzzzz", "a1b2c3d"} {
+		id, err := strconv.ParseInt(shortID, 36, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := lobstersShortID(id); got != shortID {
+			t.Errorf("lobstersShortID(%d) = %q, want %q", id, got, shortID)
+		}
+		if got, want := LobstersItemURL(id), "https://lobste.rs/s/"+shortID+".json"; got != want {
+			t.Errorf("LobstersItemURL(%d) = %q, want %q", id, got, want)
+		}
+	}
+}
+
+func TestLobstersTopItems(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	id := func(shortID string) int64 {
+		id, _ := strconv.ParseInt(shortID, 36, 64)
+		return id
+	}
+	for _, c := range []struct {
+		name string
+		// failures is the number of 503 before the list is returned.
+		failures int32
+		limit    int
+		want     []int64
+		wantErr  bool
+	}{
+		{"all", 0, 10, []int64{id("abcdef"), id("0bcdef")}, false},
+		{"limit", 0, 1, []int64{id("abcdef")}, false},
+		{"retried", 1, 10, []int64{id("abcdef"), id("0bcdef")}, false},
+		{"down", TopStoriesRetries + 1, 10, nil, true},
+	} {
+		var calls int32
+		server := newFakeServer(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&calls, 1) <= c.failures {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			// The short ID of 7 characters can't be told apart from
+			// the one of 6 without its leading zero.
+			io.WriteString(w, `[{"short_id":"abcdef"},{"short_id":"0bcdef"},{"short_id":"0abcdef"}]`)
+		})
+		got, err := lobstersSource{}.TopItems(ctx, c.limit)
+		server.Close()
+		if (err != nil) != c.wantErr || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: TopItems() = %v, %v, want %v", c.name, got, err, c.want)
+		}
+	}
+}
+
+func TestLobstersItem(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	server := newFakeServer(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/s/0bcdef.json" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, `{"short_id":"0bcdef","title":"A story","url":"https://example.com/","score":12,"comment_count":3,"comments_url":"https://lobste.rs/s/0bcdef/a_story"}`)
+	})
+	defer server.Close()
+
+	id, _ := strconv.ParseInt("0bcdef", 36, 64)
+	item, err := lobstersSource{}.Item(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.ID != id || item.Title != "A story" || *item.Score != 12 || *item.Descendants != 3 || item.CommentsURL != "https://lobste.rs/s/0bcdef/a_story" {
+		t.Errorf("Item() = %+v", item)
+	}
+	if _, err := (lobstersSource{}).Item(ctx, id+1); errors.Cause(err) != ErrItemDeleted {
+		t.Errorf("Item() of a missing story = %v, want %v", err, ErrItemDeleted)
+	}
+}
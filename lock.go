@@ -0,0 +1,70 @@
+package bots
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/appengine/datastore"
+)
+
+// PollLockTTL is how long the lock of a poll is held at most, when the poll
+// doesn't release it. It's longer than a poll may run.
+const PollLockTTL = 10 * time.Minute
+
+// errPollLocked is returned when another poll holds the lock.
+var errPollLocked = errors.New("poll already running")
+
+// PollLock is the lease of the running poll.
+type PollLock struct {
+	Expiry time.Time
+}
+
+// GetPollLockKey get a datastore key for the lock of the polls.
+func GetPollLockKey(ctx context.Context) *datastore.Key {
+	return datastore.NewKey(ctx, "PollLock", "poll", 0, nil)
+}
+
+// acquirePollLock takes the lock of the polls for ttl, and returns it to be
+// given to releasePollLock. errPollLocked is returned when another poll holds
+// the lock.
+func acquirePollLock(ctx context.Context, ttl time.Duration) (*PollLock, error) {
+	now := time.Now()
+	// Datastore keeps microseconds, the truncated expiry compares equal to
+	// the saved one.
+	lock := &PollLock{Expiry: now.Add(ttl).Truncate(time.Microsecond)}
+	key := GetPollLockKey(ctx)
+	err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		var held PollLock
+		err := datastore.Get(ctx, key, &held)
+		if err == nil && held.Expiry.After(now) {
+			return errPollLocked
+		}
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return errors.WithStack(err)
+		}
+		_, err = datastore.Put(ctx, key, lock)
+		return errors.WithStack(err)
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+// releasePollLock releases lock, unless it expired and another poll took it
+// since.
+func releasePollLock(ctx context.Context, lock *PollLock) error {
+	key := GetPollLockKey(ctx)
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		var held PollLock
+		err := datastore.Get(ctx, key, &held)
+		if err == datastore.ErrNoSuchEntity || (err == nil && !held.Expiry.Equal(lock.Expiry)) {
+			return nil
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return errors.WithStack(datastore.Delete(ctx, key))
+	}, nil)
+}
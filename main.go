@@ -2,12 +2,18 @@ package bots
 
 import (
 	"context"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	stdlog "log"
 	"net/http"
 	"os"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
@@ -15,6 +21,7 @@ import (
 	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/delay"
 	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
 	"google.golang.org/appengine/urlfetch"
 )
 
@@ -24,72 +31,410 @@ const TelegramAPIBase = `https://api.telegram.org/`
 // BatchSize is the number of top stories to fetch from Hacker News.
 const BatchSize = 30
 
-// NumCommentsThreshold is the threshold for number of comments. Story with less
-// than this threshold will not be posted in the channel.
+// MaxBatchSize is the largest number of top stories a poll may fetch.
+const MaxBatchSize = 100
+
+// NumCommentsThreshold is the default threshold for number of comments. Story
+// with less than this threshold will not be posted in the channel.
 const NumCommentsThreshold = 5
 
-// ScoreThreshold is the threshold for the score. Story with less than this
-// threshold will not be posted in the channel.
+// ScoreThreshold is the default threshold for the score. Story with less than
+// this threshold will not be posted in the channel.
 const ScoreThreshold = 50
 
 // DefaultTimeout is the default URLFetch timeout.
 const DefaultTimeout = 9 * time.Minute
 
+// MaxConcurrency is the max number of delay tasks scheduled concurrently.
+const MaxConcurrency = 8
+
 // DefaultChatID is the default chat ID.
 const DefaultChatID = `@yahnc`
 
+// EditWindow is the duration the edits scheduled by a poll are spread over.
+const EditWindow = time.Minute
+
 func loge(ctx context.Context, err error) {
 	log.Errorf(ctx, "%+v", err)
 }
 
-var editMessageFunc = delay.Func("editMessage", func(ctx context.Context, itemID int64, messageID int64) {
+// logeWith logs err prefixed by fields serialized as JSON, e.g. the item and
+// message IDs, so the logs of a story are easy to find. It's used by the delay
+// tasks, whose errors are also sent to the ops chat.
+func logeWith(ctx context.Context, err error, fields map[string]interface{}) {
+	if b, jsonErr := json.Marshal(fields); jsonErr != nil {
+		log.Errorf(ctx, "%v %+v", fields, err)
+	} else {
+		log.Errorf(ctx, "%s %+v", b, err)
+	}
+	chatID, _ := fields["chat_id"].(string)
+	maybeAlertOps(ctx, err, chatID)
+}
+
+// editMessageFunc, sendMessageFunc, batchPostFunc and reprocessFunc are
+// assigned in init since they may reschedule themselves.
+var (
+	editMessageFunc *delay.Function
+	sendMessageFunc *delay.Function
+	batchPostFunc   *delay.Function
+	reprocessFunc   *delay.Function
+)
+
+func editMessage(ctx context.Context, itemID int64, messageID int64, chatID string, feed Feed, source string) {
 	log.Infof(ctx, "editing message: id %d, message id %d", itemID, messageID)
-	story := Story{ID: itemID, MessageID: messageID}
-	err := story.EditMessage(ctx)
+	fields := map[string]interface{}{"method": "editMessage", "item_id": itemID, "message_id": messageID, "chat_id": chatID, "source": source}
+	cfg, err := LoadConfig(ctx, chatID)
 	if err != nil {
-		if errors.Cause(err) != ErrIgnoredItem {
-			loge(ctx, err)
+		logeWith(ctx, err, fields)
+		return
+	}
+	ctx = withDryRun(ctx, cfg.DryRun)
+	// Load the saved story to know what the message currently shows.
+	story, err := NewFromDatastore(ctx, source, chatID, itemID)
+	if err != nil {
+		logeWith(ctx, err, fields)
+		return
+	}
+	story.MessageID = messageID
+	story.Feed = feed
+	// Only the bot which sent the message may edit it.
+	ctx = withBot(ctx, story.BotID)
+	editCount := story.EditCount
+	err = story.EditMessage(ctx, cfg)
+	if err != nil {
+		if !isIgnored(err) &&
+			!retryLater(ctx, err, editMessageFunc, itemID, messageID, chatID, feed, source) {
+			logeWith(ctx, err, fields)
 		}
 		return
 	}
-	key := GetKey(ctx, itemID)
+	// The keep-alive saves and the saves of a frozen message send no edit.
+	if story.EditCount > editCount {
+		countEvent(ctx, CounterEdits, 1)
+	}
+	key := GetKey(ctx, source, chatID, itemID)
+	if err := updateStory(ctx, key, &story, cfg.MaxScoreSamples); err != nil {
+		if errors.Cause(err) == datastore.ErrNoSuchEntity {
+			log.Infof(ctx, "story %d was deleted while editing", itemID)
+			return
+		}
+		logeWith(ctx, err, fields)
+	}
+}
+
+// updateStory saves story in a transaction, only if it's still in datastore,
+// along with a score sample, keeping at most maxSamples of them. story must
+// have been loaded from datastore so no saved field is lost, and a story
+// deleted by the cleanup while it was edited isn't saved again.
+func updateStory(ctx context.Context, key *datastore.Key, story *Story, maxSamples int64) error {
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		var saved Story
+		if err := datastore.Get(ctx, key, &saved); err != nil {
+			return errors.WithStack(err)
+		}
+		// Polls may have scheduled another edit since story was loaded.
+		if saved.LastEditScheduled.After(story.LastEditScheduled) {
+			story.LastEditScheduled = saved.LastEditScheduled
+		}
+		// The story and its sample are saved in a single call.
+		keys, src := []*datastore.Key{key}, []interface{}{story}
+		sampleKey, sample, err := newScoreSample(ctx, key, story, maxSamples)
+		if err != nil {
+			return err
+		}
+		if sampleKey != nil {
+			keys, src = append(keys, sampleKey), append(src, sample)
+		}
+		_, err = putMulti(ctx, keys, src)
+		return errors.WithStack(err)
+	}, nil)
+}
+
+// markEditScheduled records in the story of key that an edit of it was just
+// scheduled, see Config.EditDebounceSeconds. Saving also refreshes LastSave,
+// the story is still polled.
+func markEditScheduled(ctx context.Context, key *datastore.Key) error {
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		var story Story
+		if err := datastore.Get(ctx, key, &story); err != nil {
+			return errors.WithStack(err)
+		}
+		story.LastEditScheduled = time.Now()
+		_, err := datastore.Put(ctx, key, &story)
+		return errors.WithStack(err)
+	}, nil)
+}
+
+// errAlreadyClaimed is returned when another task already claimed sending a
+// story.
+var errAlreadyClaimed = errors.New("story already claimed")
+
+// ClaimTTL is how long a story may stay claimed without a message. A task
+// holding it longer is assumed dead, e.g. it ran out of time between the claim
+// and its release, and the story may be claimed again.
+const ClaimTTL = 15 * time.Minute
+
+// isStaleClaim returns true if story is a claim with no message older than
+// ClaimTTL. Suppressed stories have no message but aren't claims.
+func isStaleClaim(story *Story, now time.Time) bool {
+	return story.MessageID == 0 && !story.Suppressed && story.LastSave.Before(now.Add(-ClaimTTL))
+}
+
+// claimStory saves story in a transaction unless it's already in datastore, so
+// only one of concurrent tasks sending the same story gets to send it. The
+// Telegram call can't be part of the transaction, so the claim is saved with a
+// zero MessageID until the message is sent. Stale claims are taken over.
+func claimStory(ctx context.Context, key *datastore.Key, story *Story) error {
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		var saved Story
+		err := datastore.Get(ctx, key, &saved)
+		if err == nil && isStaleClaim(&saved, time.Now()) {
+			log.Warningf(ctx, "taking over the claim of %d from %v", story.ID, saved.LastSave)
+			err = datastore.ErrNoSuchEntity
+		}
+		if err == nil {
+			return errAlreadyClaimed
+		}
+		if err != datastore.ErrNoSuchEntity {
+			return errors.WithStack(err)
+		}
+		_, err = datastore.Put(ctx, key, story)
+		return errors.WithStack(err)
+	}, nil)
+}
+
+// SendMaxAttempts is the number of times a send failing with an error other
+// than a rate limit is attempted before giving up.
+const SendMaxAttempts = 5
+
+// SendRetryDelay is the delay before the second attempt of a send, doubled by
+// each later attempt.
+const SendRetryDelay = 30 * time.Second
+
+// sendMessage sends the story of the given ID, at the given rank in its feed, to
+// the chat. attempt is the number of the attempt, starting from 1.
+func sendMessage(ctx context.Context, itemID int64, chatID string, feed Feed, source string, rank int64, attempt int) {
+	log.Infof(ctx, "sending message: id %d, attempt %d", itemID, attempt)
+	fields := map[string]interface{}{"method": "sendMessage", "item_id": itemID, "chat_id": chatID, "source": source, "attempt": attempt}
+	// Duplicate tasks, e.g. from overlapping polls, bail before datastore.
+	guard := sendGuardKey(source, chatID, itemID)
+	if !acquireSendGuard(ctx, guard) {
+		log.Infof(ctx, "story %d is already being sent", itemID)
+		return
+	}
+	sent := false
+	defer func() {
+		if !sent {
+			releaseSendGuard(ctx, guard)
+		}
+	}()
+	cfg, err := LoadConfig(ctx, chatID)
+	if err != nil {
+		logeWith(ctx, err, fields)
+		return
+	}
+	if cfg.Disabled {
+		log.Infof(ctx, "chat %s is disabled, dropping %d", chatID, itemID)
+		return
+	}
+	ctx = withDryRun(ctx, cfg.DryRun)
+	story := Story{ID: itemID, ChatID: chatID, Feed: feed, Source: source, Rank: rank}
+	key := GetKey(ctx, source, chatID, itemID)
+	if err := claimStory(ctx, key, &story); err != nil {
+		if errors.Cause(err) == errAlreadyClaimed {
+			log.Infof(ctx, "story already posted: %d", itemID)
+			return
+		}
+		logeWith(ctx, err, fields)
+		return
+	}
+
+	story.BotID = chooseBot(ctx, itemID)
+	err = story.SendMessage(withBot(ctx, story.BotID), cfg)
+	if err != nil {
+		// Release the claim so the story can be sent again later.
+		if err := datastore.Delete(ctx, key); err != nil {
+			logeWith(ctx, err, fields)
+		}
+		if isIgnored(err) ||
+			retryLater(ctx, err, sendMessageFunc, itemID, chatID, feed, source, rank, attempt) {
+			return
+		}
+		// Deferred sends aren't failed attempts.
+		if d, ok := deferral(err); ok {
+			log.Infof(ctx, "%v, deferring %d", err, itemID)
+			if err := callLater(ctx, sendMessageFunc, d, itemID, chatID, feed, source, rank, attempt); err != nil {
+				logeWith(ctx, err, fields)
+			}
+			return
+		}
+		if e, ok := asTelegramError(err); ok && e.IsChatGone() {
+			if err := disableChat(ctx, chatID, e.Description); err != nil {
+				logeWith(ctx, err, fields)
+			}
+			return
+		}
+		if attempt < SendMaxAttempts && !isPermanentSendError(err) {
+			d := SendRetryDelay << uint(attempt-1)
+			log.Warningf(ctx, "sending %d failed, retrying in %v: %+v", itemID, d, err)
+			retryErr := callLater(ctx, sendMessageFunc, d, itemID, chatID, feed, source, rank, attempt+1)
+			if retryErr == nil {
+				return
+			}
+			loge(ctx, retryErr)
+		}
+		logeWith(ctx, err, fields)
+		return
+	}
+	sent = true
+	fields["message_id"] = story.MessageID
+	countEvent(ctx, CounterPosted, 1)
 	if _, err := datastore.Put(ctx, key, &story); err != nil {
-		loge(ctx, err)
+		logeWith(ctx, err, fields)
 	}
-})
+}
 
-var sendMessageFunc = delay.Func("sendMessage", func(ctx context.Context, itemID int64) {
-	log.Infof(ctx, "sending message: id %d", itemID)
-	story := Story{ID: itemID}
-	err := story.SendMessage(ctx)
+// deferral returns when a send failed with err should be attempted again, and
+// true if err only means the send must wait.
+func deferral(err error) (time.Duration, bool) {
+	switch e := errors.Cause(err).(type) {
+	case *PostCapError:
+		return e.RetryAfter, true
+	case *QuietHoursError:
+		return e.RetryAfter, true
+	}
+	return 0, false
+}
+
+// isPermanentSendError returns true if sending again fails the same way, i.e.
+// Telegram rejected the request itself.
+func isPermanentSendError(err error) bool {
+	e, ok := asTelegramError(err)
+	return ok && e.Code >= 400 && e.Code < 500
+}
+
+// sentStory returns the saved story of the given ID, with the bot which sent
+// its message, or only its IDs when it's no longer saved.
+func sentStory(ctx context.Context, itemID int64, messageID int64, chatID string, source string) Story {
+	story, err := NewFromDatastore(ctx, source, chatID, itemID)
 	if err != nil {
-		if errors.Cause(err) != ErrIgnoredItem {
+		if errors.Cause(err) != datastore.ErrNoSuchEntity {
 			loge(ctx, err)
 		}
+		story = Story{ID: itemID, ChatID: chatID, Source: source}
+	}
+	story.MessageID = messageID
+	return story
+}
+
+var deleteMessageFunc = delay.Func("deleteMessage", func(ctx context.Context, itemID int64, messageID int64, chatID string, source string) {
+	log.Infof(ctx, "deleting message: id %d, message id %d", itemID, messageID)
+	fields := map[string]interface{}{"method": "deleteMessage", "item_id": itemID, "message_id": messageID, "chat_id": chatID, "source": source}
+	cfg, err := LoadConfig(ctx, chatID)
+	if err != nil {
+		logeWith(ctx, err, fields)
 		return
 	}
-	key := GetKey(ctx, itemID)
-	if _, err := datastore.Put(ctx, key, &story); err != nil {
-		loge(ctx, err)
+	story := sentStory(ctx, itemID, messageID, chatID, source)
+	// Only the bot which sent the message may delete it.
+	ctx = withBot(withDryRun(ctx, cfg.DryRun), story.BotID)
+	if err := story.DeleteMessage(ctx); err != nil {
+		logeWith(ctx, err, fields)
 	}
 })
 
-var deleteMessageFunc = delay.Func("deleteMessage", func(ctx context.Context, itemID int64, messageID int64) {
-	log.Infof(ctx, "deleting message: id %d, message id %d", itemID, messageID)
-	story := Story{ID: itemID, MessageID: messageID}
+// FallOffNote is the text of the reply posted before deleting the message of a
+// story that is no longer trending.
+const FallOffNote = "📉 no longer trending: "
+
+var expireMessageFunc = delay.Func("expireMessage", func(ctx context.Context, itemID int64, messageID int64, chatID string, source string, title string) {
+	log.Infof(ctx, "expiring message: id %d, message id %d", itemID, messageID)
+	fields := map[string]interface{}{"method": "expireMessage", "item_id": itemID, "message_id": messageID, "chat_id": chatID, "source": source}
+	cfg, err := LoadConfig(ctx, chatID)
+	if err != nil {
+		logeWith(ctx, err, fields)
+		return
+	}
+	story := sentStory(ctx, itemID, messageID, chatID, source)
+	ctx = withBot(withDryRun(ctx, cfg.DryRun), story.BotID)
+	// The message of a combined post stays, the other stories are trending.
+	if !story.Combined && messageID != 0 {
+		_, err = postMessage(ctx, SendMessageRequest{
+			ChatID:           story.MessageChatID(),
+			MessageThreadID:  story.MessageThreadID,
+			Text:             escapeMarkdownV2(FallOffNote + title),
+			ParseMode:        "MarkdownV2",
+			ReplyToMessageID: messageID,
+		})
+		if err != nil {
+			// Still delete the message, the note is best effort.
+			logeWith(ctx, err, fields)
+		}
+	}
 	if err := story.DeleteMessage(ctx); err != nil {
-		loge(ctx, err)
+		logeWith(ctx, err, fields)
 	}
 })
 
 func init() {
+	if len(envBotTokens()) == 0 {
+		stdlog.Print("BOT_KEY is not set, all the Telegram API calls will fail until a token is set with /admin/token")
+	}
+
+	editMessageFunc = delay.Func("editMessage", editMessage)
+	sendMessageFunc = delay.Func("sendMessage", sendMessage)
+	batchPostFunc = delay.Func("batchPost", batchPost)
+	reprocessFunc = delay.Func("reprocess", reprocess)
+
 	http.HandleFunc("/poll", handler)
 	http.HandleFunc("/cleanup", cleanUpHandler)
+	http.HandleFunc("/webhook", webhookHandler)
+	http.HandleFunc("/digest", digestHandler)
+	http.HandleFunc("/stats", statsHandler)
+	http.HandleFunc("/healthz", healthHandler)
+	http.HandleFunc("/backfill", backfillHandler)
+	http.HandleFunc("/debug/item/", debugItemHandler)
+	http.HandleFunc("/reprocess", reprocessHandler)
+	http.HandleFunc("/export", exportHandler)
+	http.HandleFunc("/purge", purgeHandler)
+	http.HandleFunc("/admin/token", botTokenHandler)
+	http.HandleFunc("/admin/delete", adminDeleteHandler)
+	http.HandleFunc("/admin/selftest", selfTestHandler)
+	http.HandleFunc("/admin/config", configHandler)
+	http.HandleFunc("/_ah/stop", stopHandler)
+	http.HandleFunc("/metrics", metricsHandler)
+}
+
+// callLater schedules f to be called with args after d.
+func callLater(ctx context.Context, f *delay.Function, d time.Duration, args ...interface{}) error {
+	task, err := f.Task(args...)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	task.Delay = d
+	if _, err := taskqueue.Add(ctx, task, ""); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// retryLater reschedules f with args after the delay requested by Telegram if
+// err is a RateLimitError. It returns false for any other error.
+func retryLater(ctx context.Context, err error, f *delay.Function, args ...interface{}) bool {
+	rateLimitErr, ok := asRateLimitError(err)
+	if !ok {
+		return false
+	}
+	log.Warningf(ctx, "rate limited, retrying in %v", rateLimitErr.RetryAfter)
+	if err := callLater(ctx, f, rateLimitErr.RetryAfter, args...); err != nil {
+		loge(ctx, err)
+	}
+	return true
 }
 
 // TelegramAPI is a helper function to get the Telegram API endpoint.
-func TelegramAPI(method string) string {
-	return TelegramAPIBase + os.Getenv("BOT_KEY") + "/" + method
+func TelegramAPI(ctx context.Context, method string) string {
+	return TelegramAPIBase + botToken(ctx) + "/" + method
 }
 
 // NewsURL is a helper function to get the URL to the story's HackerNews page.
@@ -102,116 +447,716 @@ func ItemURL(id int64) string {
 	return fmt.Sprintf(`https://hacker-news.firebaseio.com/v0/item/%d.json`, id)
 }
 
-// GetTopStoryURL is a helper function to get the
-func GetTopStoryURL() string {
-	return fmt.Sprintf(`https://hacker-news.firebaseio.com/v0/topstories.json?orderBy="$key"&limitToFirst=%d`, BatchSize)
+// GetTopStoryURL is a helper function to get the API of the top stories,
+// limited to the given number of stories.
+func GetTopStoryURL(limit int) string {
+	return FeedURL(FeedTop, limit)
 }
 
-// GetKey get a datastore key for the given item ID.
-func GetKey(ctx context.Context, i int64) *datastore.Key {
+// GetKey get a datastore key for the given item ID of the given source, posted
+// in the given chat. Hacker News stories of DefaultChatID stay directly under
+// the root so the entities saved before other sources and chats were supported
+// keep their keys.
+func GetKey(ctx context.Context, source, chatID string, i int64) *datastore.Key {
 	root := datastore.NewKey(ctx, "TopStory", "Root", 0, nil)
+	if source != SourceHN && source != "" {
+		root = datastore.NewKey(ctx, "Source", source, 0, root)
+	}
+	if chatID != DefaultChatID {
+		root = datastore.NewKey(ctx, "Chat", chatID, 0, root)
+	}
 	return datastore.NewKey(ctx, "Story", "", i, root)
 }
 
+// PollSummary is the response of the /poll endpoint. It's updated atomically
+// by the tasks of the poll.
+type PollSummary struct {
+	// Fetched is the number of stories fetched from the feeds.
+	Fetched int64 `json:"fetched"`
+	// Sends and Edits are the number of scheduled sends and edits.
+	Sends int64 `json:"sends"`
+	Edits int64 `json:"edits"`
+	// Skipped is the number of tasks skipped when the poll ran out of time.
+	Skipped int64 `json:"skipped"`
+	Errors  int64 `json:"errors"`
+	// EnqueueErrors is the number of tasks that failed to be enqueued, e.g.
+	// when the queue is full. They're counted in Errors too.
+	EnqueueErrors int64 `json:"enqueue_errors"`
+	// AlreadyRunning is true when the poll bailed since another one holds
+	// the lock.
+	AlreadyRunning bool `json:"already_running,omitempty"`
+}
+
+// addError counts and logs err.
+func (s *PollSummary) addError(ctx context.Context, err error) {
+	atomic.AddInt64(&s.Errors, 1)
+	loge(ctx, err)
+}
+
+// addEnqueueError counts and logs err, returned when enqueueing a task.
+func (s *PollSummary) addEnqueueError(ctx context.Context, err error) {
+	atomic.AddInt64(&s.EnqueueErrors, 1)
+	s.addError(ctx, errors.WithStack(err))
+}
+
+// handler polls the feeds and schedules the sends and edits of the stories. It
+// responds with a PollSummary, with status 200 even if some stories failed so
+// the cron doesn't retry the whole poll.
 func handler(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
+	ctx, cancel := withCronDeadline(appengine.NewContext(r))
+	defer cancel()
 
-	topStories, err := getTopStories(ctx, BatchSize)
+	limit, err := parseLimit(r.FormValue("limit"))
 	if err != nil {
-		loge(ctx, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	// nocache fetches the feeds even if they were fetched a moment ago.
+	if r.FormValue("nocache") == "" {
+		ctx = withTopStoriesTTL(ctx, configuredTopStoriesTTL(ctx))
+	}
 
-	var keys []*datastore.Key
+	var summary PollSummary
+	defer func() {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(&summary); err != nil {
+			loge(ctx, errors.WithStack(err))
+		}
+	}()
 
-	for _, story := range topStories {
-		keys = append(keys, GetKey(ctx, story))
+	// Overlapping polls, e.g. from cron retries, would race over the stories.
+	lock, err := acquirePollLock(ctx, PollLockTTL)
+	if errors.Cause(err) == errPollLocked {
+		log.Infof(ctx, "%v", err)
+		summary.AlreadyRunning = true
+		return
+	}
+	if err != nil {
+		summary.addError(ctx, err)
+		return
 	}
+	defer func() {
+		if err := releasePollLock(ctx, lock); err != nil {
+			loge(ctx, err)
+		}
+	}()
+	countEvent(ctx, CounterPolls, 1)
 
-	savedStories := make([]Story, BatchSize, BatchSize)
+	configs, err := LoadConfigs(ctx)
+	if err != nil {
+		summary.addError(ctx, err)
+	}
 
-	err = datastore.GetMulti(ctx, keys, savedStories)
-	var wg sync.WaitGroup
-	defer wg.Wait()
-	if err == nil {
-		log.Infof(ctx, "no unknown news")
-		wg.Add(len(keys))
-		for i, key := range keys {
-			go func(id, messageID int64) {
-				defer wg.Done()
-				editMessageFunc.Call(ctx, id, messageID)
-			}(key.IntID(), savedStories[i].MessageID)
+	// Feeds are shared by chats, fetch each of them only once per poll. Items
+	// aren't fetched by the poll but by the send and edit tasks, each fetching
+	// the single item it handles once.
+	feedStories := make(map[string][]int64)
+	var tasks []func()
+	for _, cfg := range configs {
+		if err := schedulingStopped(ctx); err != nil {
+			log.Warningf(ctx, "%v, not polling the remaining chats", err)
+			break
 		}
-		return
+		if cfg.Disabled {
+			log.Debugf(ctx, "chat %s disabled since %v: %s", cfg.ChatID, cfg.DisabledAt, cfg.DisabledReason)
+			continue
+		}
+		tasks = append(tasks, pollChat(ctx, cfg, feedStories, limit, &summary)...)
+	}
+	summary.Skipped = int64(runBounded(ctx, MaxConcurrency, tasks))
+	log.Infof(ctx, "scheduled %d sends and %d edits, failed to enqueue %d", summary.Sends, summary.Edits, summary.EnqueueErrors)
+}
+
+// parseLimit parses the number of stories to fetch from each feed, BatchSize
+// when s is empty. Limits above MaxBatchSize are clamped to it.
+func parseLimit(s string) (int, error) {
+	if s == "" {
+		return BatchSize, nil
 	}
+	limit, err := strconv.Atoi(s)
+	if err != nil || limit <= 0 {
+		return 0, fmt.Errorf("invalid limit %q", s)
+	}
+	if limit > MaxBatchSize {
+		limit = MaxBatchSize
+	}
+	return limit, nil
+}
 
-	multiErr, ok := err.(appengine.MultiError)
+// feedKey identifies the feed of src in the feedStories of pollChat.
+func feedKey(src Source) string {
+	return src.Name() + "/" + string(src.Feed())
+}
 
-	if !ok {
-		log.Debugf(ctx, "%v", errors.Wrap(err, "in func handler() from datastore.GetMulti()"))
-		return
+// pollChat returns the tasks scheduling the sends and edits of the first limit
+// stories in the feeds of the chat given by cfg. The work is counted in summary.
+func pollChat(ctx context.Context, cfg *Config, feedStories map[string][]int64, limit int, summary *PollSummary) []func() {
+	sources, err := cfg.PolledSources()
+	if err != nil {
+		summary.addError(ctx, err)
+		return nil
+	}
+
+	// A story may appear in several feeds of a source, only the first feed
+	// surfacing it is recorded so it's never scheduled twice.
+	var keys []*datastore.Key
+	var feeds []Feed
+	var sourceNames []string
+	var ranks []int64
+	seen := make(map[string]IntSet)
+
+	for _, src := range sources {
+		stories, ok := feedStories[feedKey(src)]
+		if !ok {
+			var err error
+			stories, err = src.TopItems(ctx, limit)
+			if err != nil {
+				summary.addError(ctx, err)
+				continue
+			}
+			feedStories[feedKey(src)] = stories
+			summary.Fetched += int64(len(stories))
+		}
+		if seen[src.Name()] == nil {
+			seen[src.Name()] = make(IntSet)
+		}
+		for i, story := range stories {
+			if seen[src.Name()].Add(story) {
+				keys = append(keys, GetKey(ctx, src.Name(), cfg.ChatID, story))
+				feeds = append(feeds, src.Feed())
+				sourceNames = append(sourceNames, src.Name())
+				ranks = append(ranks, int64(i+1))
+			}
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil
 	}
 
+	// Feeds may return fewer than limit stories, e.g. during HN outages,
+	// so the slice is sized to match keys.
+	savedStories := make([]Story, len(keys))
+
+	multiErr, err := getStories(ctx, keys, savedStories)
+	if err != nil {
+		summary.addError(ctx, errors.Wrap(err, "in func pollChat() from getStories()"))
+		return nil
+	}
+
+	var tasks []func()
+	var batch []BatchEntry
+	var keepAliveKeys []*datastore.Key
+	var keepAlive []Story
+	resurface, resurfacing := cfg.ResurfaceAfter()
+	if resurfacing {
+		for _, key := range droppedStories(ctx, cfg.ChatID, keys) {
+			key := key
+			tasks = append(tasks, func() {
+				if err := markDropped(ctx, key, time.Now()); err != nil {
+					summary.addError(ctx, err)
+				}
+			})
+		}
+	}
+	if top := feedStories[feedKey(hnSource{feed: FeedTop})]; cfg.PinTop && len(top) != 0 && seen[SourceHN].Contains(top[0]) {
+		tasks = append(tasks, func() {
+			if err := pinTopFunc.Call(ctx, cfg.ChatID, top[0]); err != nil {
+				summary.addEnqueueError(ctx, err)
+			}
+		})
+	}
+	if top := feedStories[feedKey(hnSource{feed: FeedTop})]; cfg.PinDigest && len(top) != 0 && seen[SourceHN].Contains(top[0]) {
+		if len(top) > DigestSize {
+			top = top[:DigestSize]
+		}
+		tasks = append(tasks, func() {
+			if err := pinDigestFunc.Call(ctx, cfg.ChatID, top); err != nil {
+				summary.addEnqueueError(ctx, err)
+			}
+		})
+	}
 	for i, err := range multiErr {
+		id, messageID, feed, source, rank := keys[i].IntID(), savedStories[i].MessageID, feeds[i], sourceNames[i], ranks[i]
 		switch {
+		case err == nil && savedStories[i].Suppressed:
+			log.Debugf(ctx, "story %d is suppressed", id)
+		case err == nil && messageID == 0 && !isStaleClaim(&savedStories[i], time.Now()):
+			log.Infof(ctx, "story %d is being sent to %s", id, cfg.ChatID)
+		case err == nil && messageID == 0:
+			// The send died after its claim, send it again.
+			tasks = append(tasks, func() {
+				if err := sendMessageFunc.Call(ctx, id, cfg.ChatID, feed, source, rank, 1); err != nil {
+					summary.addEnqueueError(ctx, err)
+					return
+				}
+				atomic.AddInt64(&summary.Sends, 1)
+			})
+		case err == nil && savedStories[i].Combined:
+			// Combined stories are never edited, they're saved here instead
+			// so the cleanup keeps them while they're polled.
+			if time.Since(savedStories[i].LastSave) < KeepAliveInterval {
+				log.Debugf(ctx, "story %d is in a combined post", id)
+				continue
+			}
+			keepAliveKeys = append(keepAliveKeys, keys[i])
+			keepAlive = append(keepAlive, savedStories[i])
+		case err == nil && resurfacing && !savedStories[i].DroppedAt.IsZero():
+			key := keys[i]
+			if time.Since(savedStories[i].DroppedAt) < resurface {
+				// The next poll edits it, so the edit doesn't race the mark.
+				tasks = append(tasks, func() {
+					if err := markReturned(ctx, key); err != nil {
+						summary.addError(ctx, err)
+					}
+				})
+				continue
+			}
+			// Its entity goes with its message, so the next poll posts it
+			// again as a new story.
+			log.Infof(ctx, "story %d resurfaced in %s", id, cfg.ChatID)
+			tasks = append(tasks, func() {
+				if err := deleteMessageFunc.Call(ctx, id, messageID, cfg.ChatID, source); err != nil {
+					summary.addEnqueueError(ctx, err)
+				}
+			})
 		case err == nil:
-			wg.Add(1)
-			go func(id, messageID int64) {
-				defer wg.Done()
-				editMessageFunc.Call(ctx, id, messageID)
-			}(keys[i].IntID(), savedStories[i].MessageID)
+			debounce, debounced := cfg.EditDebounce()
+			if debounced && time.Since(savedStories[i].LastEditScheduled) < debounce {
+				log.Debugf(ctx, "edit of %d already scheduled", id)
+				continue
+			}
+			key := keys[i]
+			tasks = append(tasks, func() {
+				d := spreadDelay(id, EditWindow)
+				if err := callLater(ctx, editMessageFunc, d, id, messageID, cfg.ChatID, feed, source); err != nil {
+					summary.addEnqueueError(ctx, err)
+					return
+				}
+				atomic.AddInt64(&summary.Edits, 1)
+				if debounced {
+					if err := markEditScheduled(ctx, key); err != nil {
+						summary.addError(ctx, err)
+					}
+				}
+			})
+		case err == datastore.ErrNoSuchEntity && cfg.BatchPost:
+			batch = append(batch, BatchEntry{ID: id, Feed: feed, Source: source, Rank: rank})
 		case err == datastore.ErrNoSuchEntity:
-			wg.Add(1)
-			go func(id int64) {
-				defer wg.Done()
-				sendMessageFunc.Call(ctx, id)
-			}(keys[i].IntID())
+			tasks = append(tasks, func() {
+				if err := sendMessageFunc.Call(ctx, id, cfg.ChatID, feed, source, rank, 1); err != nil {
+					summary.addEnqueueError(ctx, err)
+					return
+				}
+				atomic.AddInt64(&summary.Sends, 1)
+			})
 		default:
-			loge(ctx, err)
+			summary.addError(ctx, err)
 		}
 	}
+	if len(keepAlive) != 0 {
+		tasks = append(tasks, func() {
+			if _, err := putMulti(ctx, keepAliveKeys, keepAlive); err != nil {
+				summary.addError(ctx, errors.WithStack(err))
+			}
+		})
+	}
+	if len(batch) != 0 {
+		tasks = append(tasks, func() {
+			if err := batchPostFunc.Call(ctx, cfg.ChatID, batch); err != nil {
+				summary.addEnqueueError(ctx, err)
+				return
+			}
+			atomic.AddInt64(&summary.Sends, int64(len(batch)))
+		})
+	}
+	return tasks
+}
+
+// DatastoreRetries is the number of retries of the reads of getStories failed
+// with a transient error.
+const DatastoreRetries = 2
+
+// DatastoreRetryBackoff is the delay before the first retry of getStories. It's
+// doubled for each following retry.
+const DatastoreRetryBackoff = 100 * time.Millisecond
+
+// isTransientDatastoreError returns true if a datastore call failed with err
+// may succeed when retried.
+func isTransientDatastoreError(err error) bool {
+	err = errors.Cause(err)
+	return err == datastore.ErrConcurrentTransaction || appengine.IsTimeoutError(err)
 }
 
-func getTopStories(ctx context.Context, limit int) ([]int64, error) {
-	resp, err := myHTTPClient(ctx).Get(GetTopStoryURL())
+// getMulti loads the entities of keys into dst. It defaults to
+// datastore.GetMulti, and can be swapped to e.g. fail some of the reads.
+var getMulti = func(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	return datastore.GetMulti(ctx, keys, dst)
+}
+
+// callFunc enqueues the call of f with args. It defaults to f.Call, and can be
+// swapped to e.g. record the calls.
+var callFunc = func(ctx context.Context, f *delay.Function, args ...interface{}) error {
+	return f.Call(ctx, args...)
+}
+
+// putMulti saves the entities of src with keys. It defaults to
+// datastore.PutMulti, and can be swapped to e.g. count the calls.
+var putMulti = func(ctx context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	return datastore.PutMulti(ctx, keys, src)
+}
+
+// getStories loads the stories of keys into dst like datastore.GetMulti, and
+// returns the error of each key. The keys failed with a transient error are
+// retried, up to DatastoreRetries times.
+func getStories(ctx context.Context, keys []*datastore.Key, dst []Story) (appengine.MultiError, error) {
+	multiErr := make(appengine.MultiError, len(keys))
+	pending := make([]int, len(keys))
+	for i := range pending {
+		pending[i] = i
+	}
+
+	backoff := DatastoreRetryBackoff
+	for attempt := 0; ; attempt++ {
+		pendingKeys := make([]*datastore.Key, len(pending))
+		pendingDst := make([]Story, len(pending))
+		for j, i := range pending {
+			pendingKeys[j] = keys[i]
+		}
+		err := getMulti(ctx, pendingKeys, pendingDst)
+		errs, ok := err.(appengine.MultiError)
+		if err != nil && !ok {
+			if !isTransientDatastoreError(err) || attempt == DatastoreRetries {
+				return nil, errors.WithStack(err)
+			}
+			errs = make(appengine.MultiError, len(pending))
+			for j := range errs {
+				errs[j] = err
+			}
+		}
+
+		var retry []int
+		for j, i := range pending {
+			dst[i] = pendingDst[j]
+			multiErr[i] = nil
+			if errs != nil {
+				multiErr[i] = errs[j]
+			}
+			if multiErr[i] != nil && isTransientDatastoreError(multiErr[i]) {
+				retry = append(retry, i)
+			}
+		}
+		if len(retry) == 0 || attempt == DatastoreRetries {
+			return multiErr, nil
+		}
+		log.Warningf(ctx, "retrying %d of %d stories in %v", len(retry), len(keys), backoff)
+		pending = retry
+		select {
+		case <-ctx.Done():
+			return multiErr, nil
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// spreadDelay returns a delay in [0, window) derived from id, so the tasks of
+// different items are spread over window instead of all running at once, while
+// the task of an item runs at the same point of the window on every poll.
+func spreadDelay(id int64, window time.Duration) time.Duration {
+	if window <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	binary.Write(h, binary.LittleEndian, id)
+	return time.Duration(h.Sum64() % uint64(window))
+}
+
+// runBounded runs tasks concurrently, at most limit of them at a time, and
+// waits for all of them to finish. It stops starting tasks once ctx is done, and
+// returns the number of skipped tasks.
+func runBounded(ctx context.Context, limit int, tasks []func()) int {
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for i, task := range tasks {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		case <-drain:
+		}
+		if err := schedulingStopped(ctx); err != nil {
+			skipped := len(tasks) - i
+			log.Warningf(ctx, "%v, skipped %d of %d tasks", err, skipped, len(tasks))
+			return skipped
+		}
+		wg.Add(1)
+		go func(task func()) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			task()
+		}(task)
+	}
+	return 0
+}
+
+// TopStoriesRetries is the number of retries of a top story list fetch failed
+// with a network error or a 5xx response.
+const TopStoriesRetries = 2
+
+// TopStoriesRetryBackoff is the delay before the first retry of a top story
+// list fetch. It's doubled for each following retry.
+const TopStoriesRetryBackoff = 500 * time.Millisecond
+
+// getTopStories fetches the first limit stories of feed. Network errors and 5xx
+// responses are retried, malformed lists aren't.
+func getTopStories(ctx context.Context, feed Feed, limit int) ([]int64, error) {
+	backoff := TopStoriesRetryBackoff
+	for attempt := 1; ; attempt++ {
+		ret, retry, err := fetchTopStories(ctx, feed, limit)
+		if err == nil || !retry || attempt > TopStoriesRetries {
+			return ret, err
+		}
+		log.Warningf(ctx, "retrying the %s feed in %v: %v", feed, backoff, err)
+		select {
+		case <-ctx.Done():
+			return nil, errors.WithStack(ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// fetchTopStories fetches the first limit stories of feed once, and returns
+// whether a failed fetch may be retried.
+func fetchTopStories(ctx context.Context, feed Feed, limit int) ([]int64, bool, error) {
+	resp, err := httpGet(ctx, FeedURL(feed, limit))
 	if err != nil {
-		return nil, errors.Wrap(err, "getTopStories -> http.Client.Get")
+		return nil, true, errors.Wrap(err, "getTopStories -> http.Client.Get")
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		err := fmt.Errorf("getTopStories: %s", resp.Status)
+		return nil, resp.StatusCode >= http.StatusInternalServerError, errors.WithStack(err)
+	}
 
 	var ret []int64
 	if err := json.NewDecoder(resp.Body).Decode(&ret); err != nil {
-		return nil, errors.Wrap(err, "in getTopStories from json.Decoder.Decode()")
+		return nil, false, errors.Wrap(err, "in getTopStories from json.Decoder.Decode()")
 	}
 
-	return ret, nil
+	return ret, false, nil
+}
+
+// Doer is the interface of the HTTP client sending the outgoing requests.
+type Doer interface {
+	Do(req *http.Request) (*http.Response, error)
 }
 
+// newHTTPClient returns the Doer sending the outgoing requests of ctx. It
+// defaults to the URLFetch client, and can be swapped to send the requests to
+// e.g. an httptest.Server.
+var newHTTPClient = func(ctx context.Context) Doer {
+	return myHTTPClient(ctx)
+}
+
+// DefaultUserAgent identifies the outgoing requests unless USER_AGENT sets
+// another User-Agent.
+const DefaultUserAgent = "yegle-bots/1.0 (+https://t.me/yahnc)"
+
+// userAgent returns the User-Agent of the outgoing requests.
+func userAgent() string {
+	if ua := os.Getenv("USER_AGENT"); ua != "" {
+		return ua
+	}
+	return DefaultUserAgent
+}
+
+// newRequest returns an outgoing request, identified by userAgent.
+func newRequest(method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	req.Header.Set("User-Agent", userAgent())
+	return req, nil
+}
+
+// httpGet sends a GET request to url.
+func httpGet(ctx context.Context, url string) (*http.Response, error) {
+	req, err := newRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return newHTTPClient(ctx).Do(req)
+}
+
+// myHTTPClient returns the URLFetch client of ctx, with DefaultTimeout for the
+// batch handlers. Interactive handlers set a shorter deadline on ctx, which
+// then takes precedence.
 func myHTTPClient(ctx context.Context) *http.Client {
 	withTimeout, _ := context.WithTimeout(ctx, DefaultTimeout)
 	return urlfetch.Client(withTimeout)
 }
 
+// CleanupBatchSize is the number of stale stories read by each query of the
+// cleanup.
+const CleanupBatchSize = 200
+
+// CleanupMaxBatches bounds the batches of stories handled by one cleanup. The
+// next cleanup resumes from its checkpoint.
+const CleanupMaxBatches = 10
+
+// CleanupCheckpoint is where an unfinished cleanup stopped. The query cursor is
+// only valid for the same query, so the cutoff of the query is kept with it.
+type CleanupCheckpoint struct {
+	Cutoff time.Time
+	Cursor string `datastore:",noindex"`
+}
+
+// GetCleanupCheckpointKey get a datastore key for the checkpoint of the
+// cleanup.
+func GetCleanupCheckpointKey(ctx context.Context) *datastore.Key {
+	return datastore.NewKey(ctx, "CleanupCheckpoint", "cleanup", 0, nil)
+}
+
+// cleanUpCounts counts the tasks enqueued by a cleanup. It's updated atomically
+// by the cleanup tasks.
+type cleanUpCounts struct {
+	Scheduled int64
+	Failed    int64
+}
+
+// add counts the enqueue of a task, failed when err isn't nil.
+func (c *cleanUpCounts) add(ctx context.Context, err error) {
+	if err != nil {
+		atomic.AddInt64(&c.Failed, 1)
+		loge(ctx, errors.WithStack(err))
+		return
+	}
+	atomic.AddInt64(&c.Scheduled, 1)
+}
+
 func cleanUpHandler(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
-	var allStories []Story
+	ctx, cancel := withCronDeadline(appengine.NewContext(r))
+	defer cancel()
 
-	now := time.Now()
-	oneDayAgo := now.Add(-24 * time.Hour)
-	_, err := datastore.NewQuery("Story").Filter("LastSave <=", oneDayAgo).GetAll(ctx, &allStories)
+	configs, err := LoadConfigs(ctx)
 	if err != nil {
 		loge(ctx, err)
 		return
 	}
+	// Chats without a config, e.g. removed ones, use the default retention.
+	configsByChat := make(map[string]*Config)
+	minRetention := time.Duration(DefaultRetentionHours) * time.Hour
+	for _, cfg := range configs {
+		configsByChat[cfg.ChatID] = cfg
+		if retention, ok := cfg.Retention(); ok && retention < minRetention {
+			minRetention = retention
+		}
+	}
 
-	var wg sync.WaitGroup
-	defer wg.Wait()
+	var counts cleanUpCounts
+	defer func() {
+		log.Infof(ctx, "cleanup scheduled %d, failed to enqueue %d", counts.Scheduled, counts.Failed)
+	}()
 
-	for _, story := range allStories {
-		wg.Add(1)
-		go func(id, messageID int64) {
-			defer wg.Done()
-			deleteMessageFunc.Call(ctx, id, messageID)
-		}(story.ID, story.MessageID)
+	// Query with the shortest retention, then keep the stories past the
+	// retention of their own chat. An unfinished cleanup is resumed with
+	// its query.
+	now := time.Now()
+	checkpointKey := GetCleanupCheckpointKey(ctx)
+	checkpoint := CleanupCheckpoint{Cutoff: now.Add(-minRetention)}
+	if err := datastore.Get(ctx, checkpointKey, &checkpoint); err != nil && err != datastore.ErrNoSuchEntity {
+		loge(ctx, errors.WithStack(err))
+		return
+	}
+
+	for batch := 0; batch < CleanupMaxBatches; batch++ {
+		// The checkpoint of the last batch is saved, the next cleanup
+		// resumes from it.
+		if err := schedulingStopped(ctx); err != nil {
+			log.Warningf(ctx, "%v, cleanup stopped after %d batches", err, batch)
+			return
+		}
+		q := datastore.NewQuery("Story").Filter("LastSave <=", checkpoint.Cutoff).Limit(CleanupBatchSize)
+		if checkpoint.Cursor != "" {
+			cursor, err := datastore.DecodeCursor(checkpoint.Cursor)
+			if err != nil {
+				loge(ctx, errors.WithStack(err))
+				datastore.Delete(ctx, checkpointKey)
+				return
+			}
+			q = q.Start(cursor)
+		}
+
+		var tasks []func()
+		n := 0
+		it := q.Run(ctx)
+		for {
+			var story Story
+			_, err := it.Next(&story)
+			if err == datastore.Done {
+				break
+			}
+			if err != nil {
+				loge(ctx, errors.WithStack(err))
+				return
+			}
+			n++
+			if task := cleanUpTask(ctx, configsByChat, story, now, &counts); task != nil {
+				tasks = append(tasks, task)
+			}
+		}
+		if skipped := runBounded(ctx, MaxConcurrency, tasks); skipped > 0 {
+			// Keep the checkpoint before the batch, so the next cleanup
+			// goes over the skipped stories.
+			return
+		}
+
+		if n < CleanupBatchSize {
+			// Done, the next cleanup starts over.
+			if err := datastore.Delete(ctx, checkpointKey); err != nil {
+				loge(ctx, errors.WithStack(err))
+			}
+			return
+		}
+		cursor, err := it.Cursor()
+		if err != nil {
+			loge(ctx, errors.WithStack(err))
+			return
+		}
+		checkpoint.Cursor = cursor.String()
+		if _, err := datastore.Put(ctx, checkpointKey, &checkpoint); err != nil {
+			loge(ctx, errors.WithStack(err))
+			return
+		}
+	}
+	log.Infof(ctx, "cleanup stopped after %d batches, the next one resumes", CleanupMaxBatches)
+}
+
+// cleanUpTask returns the task scheduling the cleanup of story if it's past the
+// retention of its chat, or nil. The enqueue of the task is counted in counts.
+func cleanUpTask(ctx context.Context, configsByChat map[string]*Config, story Story, now time.Time, counts *cleanUpCounts) func() {
+	cfg, ok := configsByChat[story.ChatID]
+	if !ok {
+		cfg = DefaultConfig(story.ChatID)
+	}
+	retention, ok := cfg.Retention()
+	if !ok || story.LastSave.After(now.Add(-retention)) {
+		return nil
+	}
+	id, messageID, chatID, source, title := story.ID, story.MessageID, story.ChatID, story.Source, story.Title
+	if cfg.NotifyFallOff {
+		return func() {
+			counts.add(ctx, callFunc(ctx, expireMessageFunc, id, messageID, chatID, source, title))
+		}
+	}
+	return func() {
+		counts.add(ctx, callFunc(ctx, deleteMessageFunc, id, messageID, chatID, source))
 	}
 }
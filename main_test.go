@@ -0,0 +1,576 @@
+package bots
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/delay"
+	"google.golang.org/appengine/memcache"
+)
+
+// testBotKey is the bot token of the tests.
+const testBotKey = "123:test"
+
+// newTestContext returns the context of a request to a new test instance, and
+// the function closing it.
+func newTestContext(t *testing.T) (context.Context, func()) {
+	req, done := newTestRequest(t, http.MethodGet, "/", nil)
+	return appengine.NewContext(req), done
+}
+
+// newTestRequest returns a request to a new test instance, e.g. to call a
+// handler with, and the function closing the instance.
+func newTestRequest(t *testing.T, method, urlStr string, body io.Reader) (*http.Request, func()) {
+	inst, err := aetest.NewInstance(&aetest.Options{StronglyConsistentDatastore: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := inst.NewRequest(method, urlStr, body)
+	if err != nil {
+		inst.Close()
+		t.Fatal(err)
+	}
+	os.Setenv("BOT_KEY", testBotKey)
+	botTokenCache.Lock()
+	botTokenCache.tokens, botTokenCache.expiry = nil, time.Time{}
+	botTokenCache.Unlock()
+	return req, func() { inst.Close() }
+}
+
+// putStory saves story with key as if it was last saved at lastSave, which
+// Story.Save sets to the current time.
+func putStory(ctx context.Context, t *testing.T, key *datastore.Key, story *Story, lastSave time.Time) {
+	props, err := story.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range props {
+		if props[i].Name == "LastSave" {
+			props[i].Value = lastSave
+		}
+	}
+	list := datastore.PropertyList(props)
+	if _, err := datastore.Put(ctx, key, &list); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fakeRequest is a request received by a fakeServer.
+type fakeRequest struct {
+	Host, Path string
+	Body       []byte
+}
+
+// Method returns the Telegram method of the request.
+func (r fakeRequest) Method() string {
+	return path.Base(r.Path)
+}
+
+// fakeServer answers the outgoing requests of the tests in place of Telegram
+// and the story sources. The requests are sent to it by newHTTPClient, with
+// their host left in Host.
+type fakeServer struct {
+	*httptest.Server
+	prevHTTPClient func(ctx context.Context) Doer
+
+	mu       sync.Mutex
+	requests []fakeRequest
+}
+
+// newFakeServer starts a fakeServer answering with handler, until it's closed.
+func newFakeServer(handler http.HandlerFunc) *fakeServer {
+	s := &fakeServer{prevHTTPClient: newHTTPClient}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		s.mu.Lock()
+		s.requests = append(s.requests, fakeRequest{Host: r.Host, Path: r.URL.Path, Body: body})
+		s.mu.Unlock()
+		handler(w, r)
+	}))
+	target, _ := url.Parse(s.URL)
+	newHTTPClient = func(ctx context.Context) Doer {
+		return doerFunc(func(req *http.Request) (*http.Response, error) {
+			req.Host = req.URL.Host
+			req.URL.Scheme, req.URL.Host = target.Scheme, target.Host
+			return http.DefaultClient.Do(req.WithContext(ctx))
+		})
+	}
+	return s
+}
+
+// Close stops the server and restores newHTTPClient.
+func (s *fakeServer) Close() {
+	newHTTPClient = s.prevHTTPClient
+	s.Server.Close()
+}
+
+// reset forgets the requests received.
+func (s *fakeServer) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = nil
+}
+
+// Requests returns the requests received for the given host.
+func (s *fakeServer) Requests(host string) []fakeRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ret []fakeRequest
+	for _, r := range s.requests {
+		if r.Host == host {
+			ret = append(ret, r)
+		}
+	}
+	return ret
+}
+
+// TelegramRequests returns the requests received for the Telegram API.
+func (s *fakeServer) TelegramRequests() []fakeRequest {
+	return s.Requests("api.telegram.org")
+}
+
+// doerFunc is a Doer calling the function.
+type doerFunc func(req *http.Request) (*http.Response, error)
+
+func (f doerFunc) Do(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestCleanUpTask(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	now := time.Now()
+	configsByChat := map[string]*Config{
+		"@short":  {ChatID: "@short", RetentionHours: 2},
+		"@keep":   {ChatID: "@keep", RetentionHours: 0},
+		"@notify": {ChatID: "@notify", RetentionHours: 2, NotifyFallOff: true},
+	}
+	for _, c := range []struct {
+		chatID string
+		age    time.Duration
+		want   bool
+	}{
+		{"@short", time.Hour, false},
+		{"@short", 2*time.Hour - time.Minute, false},
+		{"@short", 2*time.Hour + time.Minute, true},
+		{"@notify", 3 * time.Hour, true},
+		// Chats without a config have the default retention.
+		{"@removed", 23 * time.Hour, false},
+		{"@removed", 25 * time.Hour, true},
+		{"@keep", 1000 * time.Hour, false},
+	} {
+		var counts cleanUpCounts
+		story := Story{ID: 1, ChatID: c.chatID, MessageID: 42, LastSave: now.Add(-c.age)}
+		task := cleanUpTask(ctx, configsByChat, story, now, &counts)
+		if got := task != nil; got != c.want {
+			t.Errorf("cleanUpTask() of %s saved %v ago scheduled %v, want %v", c.chatID, c.age, got, c.want)
+		}
+		if task == nil {
+			continue
+		}
+		task()
+		if counts.Scheduled != 1 || counts.Failed != 0 {
+			t.Errorf("cleanUpTask() of %s counted %+v, want one scheduled", c.chatID, counts)
+		}
+	}
+}
+
+func TestCleanUpHandler(t *testing.T) {
+	req, done := newTestRequest(t, http.MethodGet, "/cleanup", nil)
+	defer done()
+	ctx := appengine.NewContext(req)
+	var mu sync.Mutex
+	var deleted, expired []string
+	defer func(orig func(context.Context, *delay.Function, ...interface{}) error) { callFunc = orig }(callFunc)
+	callFunc = func(ctx context.Context, f *delay.Function, args ...interface{}) error {
+		mu.Lock()
+		defer mu.Unlock()
+		story := fmt.Sprintf("%s/%d", args[2], args[0])
+		switch f {
+		case deleteMessageFunc:
+			deleted = append(deleted, story)
+		case expireMessageFunc:
+			expired = append(expired, story)
+		default:
+			t.Errorf("unexpected call of %v", f)
+		}
+		return nil
+	}
+
+	for _, cfg := range []*Config{
+		{ChatID: "@short", RetentionHours: 2},
+		{ChatID: "@long", RetentionHours: 48},
+		{ChatID: "@keep", RetentionHours: 0},
+		{ChatID: "@notify", RetentionHours: 2, NotifyFallOff: true},
+	} {
+		if _, err := datastore.Put(ctx, GetConfigKey(ctx, cfg.ChatID), cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The stories are saved a minute on both sides of the retention of
+	// their chat. Chats without a config have the default retention.
+	now := time.Now()
+	for i, c := range []struct {
+		chatID string
+		age    time.Duration
+	}{
+		{"@short", 2*time.Hour - time.Minute},
+		{"@short", 2*time.Hour + time.Minute},
+		{"@long", 48*time.Hour - time.Minute},
+		{"@long", 48*time.Hour + time.Minute},
+		{"@notify", 2*time.Hour - time.Minute},
+		{"@notify", 2*time.Hour + time.Minute},
+		{"@removed", DefaultRetentionHours*time.Hour - time.Minute},
+		{"@removed", DefaultRetentionHours*time.Hour + time.Minute},
+		{"@keep", 1000 * time.Hour},
+	} {
+		id := int64(i + 1)
+		putStory(ctx, t, GetKey(ctx, SourceHN, c.chatID, id), &Story{ID: id, ChatID: c.chatID, MessageID: 42}, now.Add(-c.age))
+	}
+
+	cleanUpHandler(httptest.NewRecorder(), req)
+	sort.Strings(deleted)
+	if want := []string{"@long/4", "@removed/8", "@short/2"}; !reflect.DeepEqual(deleted, want) {
+		t.Errorf("cleanUpHandler() deleted %v, want %v", deleted, want)
+	}
+	if want := []string{"@notify/6"}; !reflect.DeepEqual(expired, want) {
+		t.Errorf("cleanUpHandler() expired %v, want %v", expired, want)
+	}
+}
+
+func TestEditMessageCounted(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	var score int64
+	server := newFakeServer(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host == "hacker-news.firebaseio.com" {
+			fmt.Fprintf(w, `{"id":1,"type":"story","title":"A story","url":"https://example.com/","score":%d,"descendants":100}`, atomic.LoadInt64(&score))
+			return
+		}
+		io.WriteString(w, `{"ok":true,"result":true}`)
+	})
+	defer server.Close()
+	counted := func() uint64 {
+		item, err := memcache.Get(ctx, counterKey(CounterEdits))
+		if err == memcache.ErrCacheMiss {
+			return 0
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := strconv.ParseUint(string(item.Value), 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	key := GetKey(ctx, SourceHN, "@chat", 1)
+	story := &Story{ID: 1, Type: "story", Title: "A story", URL: "https://example.com/", Score: 100, Descendants: 100, ChatID: "@chat", MessageID: 42, EditCount: 1}
+	story.posted(DefaultConfig("@chat"))
+	putStory(ctx, t, key, story, time.Now().Add(-KeepAliveInterval))
+	for i, c := range []struct {
+		maxEdits int64
+		score    int64
+		// age is how long ago the story was last saved.
+		age        time.Duration
+		wantMethod string
+		wantCount  uint64
+	}{
+		// The saves of a frozen message send no edit.
+		{1, 105, KeepAliveInterval, "", 0},
+		{0, 120, 0, "editMessageText", 1},
+		// Nor the keep-alive saves.
+		{0, 120, KeepAliveInterval, "", 1},
+	} {
+		server.reset()
+		cfg := &Config{ChatID: "@chat", MaxEdits: c.maxEdits}
+		if _, err := datastore.Put(ctx, GetConfigKey(ctx, cfg.ChatID), cfg); err != nil {
+			t.Fatal(err)
+		}
+		saved, err := NewFromDatastore(ctx, SourceHN, "@chat", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		putStory(ctx, t, key, &saved, time.Now().Add(-c.age))
+		atomic.StoreInt64(&score, c.score)
+
+		editMessage(ctx, 1, 42, "@chat", FeedTop, SourceHN)
+		var methods []string
+		for _, r := range server.TelegramRequests() {
+			methods = append(methods, r.Method())
+		}
+		if strings.Join(methods, ",") != c.wantMethod {
+			t.Errorf("edit %d: called %v, want %q", i+1, methods, c.wantMethod)
+		}
+		if got := counted(); got != c.wantCount {
+			t.Errorf("edit %d: %d edits counted, want %d", i+1, got, c.wantCount)
+		}
+		saved, err = NewFromDatastore(ctx, SourceHN, "@chat", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if saved.Score != c.score {
+			t.Errorf("edit %d: saved score %d, want %d", i+1, saved.Score, c.score)
+		}
+	}
+}
+
+func TestPollChatFewerStories(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	server := newFakeServer(func(w http.ResponseWriter, r *http.Request) {
+		// An outage returns a few of the BatchSize stories.
+		io.WriteString(w, "[1,2,3]")
+	})
+	defer server.Close()
+
+	cfg := DefaultConfig(DefaultChatID)
+	saved := map[int64]Story{
+		2: {ID: 2, ChatID: DefaultChatID, MessageID: 42, LastSave: time.Now()},
+		3: {ID: 3, ChatID: DefaultChatID, MessageID: 43, Combined: true, LastSave: time.Now()},
+	}
+	for id, s := range saved {
+		s := s
+		if _, err := datastore.Put(ctx, GetKey(ctx, SourceHN, DefaultChatID, id), &s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var summary PollSummary
+	tasks := pollChat(ctx, cfg, make(map[string][]int64), BatchSize, &summary)
+	if skipped := runBounded(ctx, MaxConcurrency, tasks); skipped != 0 {
+		t.Fatalf("%d tasks skipped", skipped)
+	}
+	want := PollSummary{Fetched: 3, Sends: 1, Edits: 1}
+	if summary != want {
+		t.Errorf("pollChat() summary = %+v, want %+v", summary, want)
+	}
+}
+
+func TestClaimStory(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	now := time.Now()
+	for _, c := range []struct {
+		name  string
+		saved *Story
+		age   time.Duration
+		want  error
+	}{
+		{"new", nil, 0, nil},
+		{"sent", &Story{ID: 1, MessageID: 42}, time.Hour, errAlreadyClaimed},
+		{"claimed", &Story{ID: 1}, ClaimTTL / 2, errAlreadyClaimed},
+		{"stale claim", &Story{ID: 1}, 2 * ClaimTTL, nil},
+		{"suppressed", &Story{ID: 1, Suppressed: true}, 2 * ClaimTTL, errAlreadyClaimed},
+	} {
+		key := GetKey(ctx, SourceHN, "@"+strings.Replace(c.name, " ", "_", -1), 1)
+		if c.saved != nil {
+			putStory(ctx, t, key, c.saved, now.Add(-c.age))
+		}
+		if err := claimStory(ctx, key, &Story{ID: 1}); errors.Cause(err) != c.want {
+			t.Errorf("%s: claimStory() = %v, want %v", c.name, err, c.want)
+		}
+	}
+}
+
+func TestClaimStoryConcurrent(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	key := GetKey(ctx, SourceHN, DefaultChatID, 1)
+	var claimed, rejected int64
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			switch err := claimStory(ctx, key, &Story{ID: 1}); errors.Cause(err) {
+			case nil:
+				atomic.AddInt64(&claimed, 1)
+			case errAlreadyClaimed:
+				atomic.AddInt64(&rejected, 1)
+			default:
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if claimed != 1 || rejected != 9 {
+		t.Errorf("%d claimed and %d rejected, want 1 and 9", claimed, rejected)
+	}
+}
+
+func TestSendMessageOnce(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	server := newFakeServer(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host == "hacker-news.firebaseio.com" {
+			io.WriteString(w, `{"id":1,"type":"story","title":"A story","url":"https://example.com/","score":1000,"descendants":100}`)
+			return
+		}
+		io.WriteString(w, `{"ok":true,"result":{"message_id":42}}`)
+	})
+	defer server.Close()
+
+	// Tasks of overlapping polls send the same story.
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sendMessage(ctx, 1, DefaultChatID, FeedTop, SourceHN, 1, 1)
+		}()
+	}
+	wg.Wait()
+	if reqs := server.TelegramRequests(); len(reqs) != 1 || reqs[0].Method() != "sendMessage" {
+		t.Errorf("Telegram requests %v, want one sendMessage", reqs)
+	}
+	story, err := NewFromDatastore(ctx, SourceHN, DefaultChatID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if story.MessageID != 42 {
+		t.Errorf("saved MessageID = %d, want 42", story.MessageID)
+	}
+}
+
+func TestGetStoriesRetries(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	var keys []*datastore.Key
+	for id := int64(1); id <= 4; id++ {
+		keys = append(keys, GetKey(ctx, SourceHN, DefaultChatID, id))
+		// Story 4 isn't saved.
+		if id != 4 {
+			putStory(ctx, t, keys[id-1], &Story{ID: id, MessageID: 40 + id}, time.Now())
+		}
+	}
+	internalErr := errors.New("API error 4 (datastore_v3: INTERNAL_ERROR)")
+	defer func(prev func(context.Context, []*datastore.Key, interface{}) error) {
+		getMulti = prev
+	}(getMulti)
+	for _, c := range []struct {
+		name string
+		// failures are the errors of the reads of each attempt, by ID. A
+		// nil error is a read of datastore.
+		failures []map[int64]error
+		want     []error
+		wantErr  bool
+		// reads is the expected number of keys read by each attempt.
+		reads []int
+	}{
+		{"no failure", nil, []error{nil, nil, nil, datastore.ErrNoSuchEntity}, false, []int{4}},
+		{"partial failure", []map[int64]error{{2: datastore.ErrConcurrentTransaction}}, []error{nil, nil, nil, datastore.ErrNoSuchEntity}, false, []int{4, 1}},
+		{"retries exhausted", []map[int64]error{{2: datastore.ErrConcurrentTransaction}, {2: datastore.ErrConcurrentTransaction}, {2: datastore.ErrConcurrentTransaction}}, []error{nil, datastore.ErrConcurrentTransaction, nil, datastore.ErrNoSuchEntity}, false, []int{4, 1, 1}},
+		{"permanent failure", []map[int64]error{{1: datastore.ErrInvalidEntityType}}, []error{datastore.ErrInvalidEntityType, nil, nil, datastore.ErrNoSuchEntity}, false, []int{4}},
+		{"call failed", []map[int64]error{{0: datastore.ErrConcurrentTransaction}}, []error{nil, nil, nil, datastore.ErrNoSuchEntity}, false, []int{4, 4}},
+		{"call failed permanently", []map[int64]error{{0: internalErr}}, nil, true, []int{4}},
+	} {
+		var reads []int
+		getMulti = func(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+			attempt := len(reads)
+			reads = append(reads, len(keys))
+			var failures map[int64]error
+			if attempt < len(c.failures) {
+				failures = c.failures[attempt]
+			}
+			// The whole call fails with the error of ID 0.
+			if err := failures[0]; err != nil {
+				return err
+			}
+			err := datastore.GetMulti(ctx, keys, dst)
+			multiErr, _ := err.(appengine.MultiError)
+			if multiErr == nil {
+				multiErr = make(appengine.MultiError, len(keys))
+			}
+			failed := false
+			for i, key := range keys {
+				if err := failures[key.IntID()]; err != nil {
+					multiErr[i] = err
+				}
+				failed = failed || multiErr[i] != nil
+			}
+			if !failed {
+				return nil
+			}
+			return multiErr
+		}
+		dst := make([]Story, len(keys))
+		got, err := getStories(ctx, keys, dst)
+		if (err != nil) != c.wantErr {
+			t.Errorf("%s: getStories() = %v, want an error %v", c.name, err, c.wantErr)
+		}
+		for i := range c.want {
+			if errors.Cause(got[i]) != c.want[i] {
+				t.Errorf("%s: error of %d = %v, want %v", c.name, i+1, got[i], c.want[i])
+			}
+			if c.want[i] == nil && dst[i].MessageID != 41+int64(i) {
+				t.Errorf("%s: story %d loaded %+v", c.name, i+1, dst[i])
+			}
+		}
+		if !reflect.DeepEqual(reads, c.reads) {
+			t.Errorf("%s: read %v keys, want %v", c.name, reads, c.reads)
+		}
+	}
+}
+
+func TestGetTopStoriesRetries(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	for _, c := range []struct {
+		name string
+		// responses are the status and body of each fetch, the last one
+		// is repeated.
+		responses []string
+		want      []int64
+		fetches   int
+	}{
+		{"ok", []string{"200 [1,2,3]"}, []int64{1, 2, 3}, 1},
+		{"flaky", []string{"503 ", "200 [1,2,3]"}, []int64{1, 2, 3}, 2},
+		{"down", []string{"500 "}, nil, TopStoriesRetries + 1},
+		// Malformed lists and client errors aren't retried.
+		{"malformed", []string{"200 {", "200 [1,2,3]"}, nil, 1},
+		{"not found", []string{"404 ", "200 [1,2,3]"}, nil, 1},
+	} {
+		var fetches int32
+		server := newFakeServer(func(w http.ResponseWriter, r *http.Request) {
+			i := int(atomic.AddInt32(&fetches, 1)) - 1
+			if i >= len(c.responses) {
+				i = len(c.responses) - 1
+			}
+			status, body := c.responses[i][:3], c.responses[i][4:]
+			code, _ := strconv.Atoi(status)
+			w.WriteHeader(code)
+			io.WriteString(w, body)
+		})
+		got, err := getTopStories(ctx, FeedTop, 3)
+		server.Close()
+		if !reflect.DeepEqual(got, c.want) || (err == nil) != (c.want != nil) {
+			t.Errorf("%s: getTopStories() = %v, %v, want %v", c.name, got, err, c.want)
+		}
+		if int(fetches) != c.fetches {
+			t.Errorf("%s: %d fetches, want %d", c.name, fetches, c.fetches)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package bots
+
+import (
+	"bytes"
+	"strings"
+	"unicode/utf8"
+)
+
+// markdownV2Replacer escapes every character reserved by Telegram's MarkdownV2.
+var markdownV2Replacer = strings.NewReplacer(
+	`\`, `\\`,
+	`_`, `\_`,
+	`*`, `\*`,
+	`[`, `\[`,
+	`]`, `\]`,
+	`(`, `\(`,
+	`)`, `\)`,
+	`~`, `\~`,
+	"`", "\\`",
+	`>`, `\>`,
+	`#`, `\#`,
+	`+`, `\+`,
+	`-`, `\-`,
+	`=`, `\=`,
+	`|`, `\|`,
+	`{`, `\{`,
+	`}`, `\}`,
+	`.`, `\.`,
+	`!`, `\!`,
+)
+
+// escapeMarkdownV2 escapes s so it's displayed as is in a MarkdownV2 message.
+func escapeMarkdownV2(s string) string {
+	return markdownV2Replacer.Replace(s)
+}
+
+// MaxMessageLength is the max length of the text of a message, see
+// markdownV2Length.
+const MaxMessageLength = 4096
+
+// truncateForTelegram truncates the MarkdownV2 text s to MaxMessageLength.
+func truncateForTelegram(s string) string {
+	return truncateMarkdownV2(s, MaxMessageLength)
+}
+
+// markdownV2Length returns the length of the MarkdownV2 text s the way Telegram
+// counts it, in UTF-16 code units of the text once its entities are parsed.
+func markdownV2Length(s string) int {
+	n := 0
+	scanMarkdownV2(s, func(end, width int, closers []string) bool {
+		n += width
+		return true
+	})
+	return n
+}
+
+// truncateMarkdownV2 truncates the MarkdownV2 text s to max, as counted by
+// markdownV2Length, ending it with an ellipsis. Neither a character, an escape
+// nor a link URL is cut, and the entities left open by the cut are closed so
+// Telegram can still parse the text.
+func truncateMarkdownV2(s string, max int) string {
+	if markdownV2Length(s) <= max {
+		return s
+	}
+	left := max - markdownV2Length(Ellipsis)
+	cut := 0
+	var open []string
+	scanMarkdownV2(s, func(end, width int, closers []string) bool {
+		if left -= width; left < 0 {
+			return false
+		}
+		cut, open = end, closers
+		return true
+	})
+	var buf bytes.Buffer
+	buf.WriteString(s[:cut])
+	buf.WriteString(Ellipsis)
+	for i := len(open) - 1; i >= 0; i-- {
+		buf.WriteString(open[i])
+	}
+	return buf.String()
+}
+
+// markdownV2Entity is an entity opened in a MarkdownV2 text.
+type markdownV2Entity struct {
+	// closer is the markup closing the entity.
+	closer string
+	// at is the offset of the closer of a link, found when it's opened.
+	at int
+}
+
+// scanMarkdownV2 splits the MarkdownV2 text s into the units it must not be
+// cut within: graphemes, escapes, entity markers and link URLs. visit is called
+// with the end offset of each unit, its width once parsed in UTF-16 code units,
+// and the closers of the entities open after it, until it returns false.
+func scanMarkdownV2(s string, visit func(end, width int, closers []string) bool) {
+	var open []markdownV2Entity
+	closers := func() []string {
+		ret := make([]string, len(open))
+		for i, e := range open {
+			ret[i] = e.closer
+		}
+		return ret
+	}
+	// toggle opens the entity of marker, or closes it when it's the
+	// innermost one.
+	toggle := func(marker string) {
+		if n := len(open); n != 0 && open[n-1].at < 0 && open[n-1].closer == marker {
+			open = open[:n-1]
+		} else {
+			open = append(open, markdownV2Entity{closer: marker, at: -1})
+		}
+	}
+
+	for i := 0; i < len(s); {
+		inCode := len(open) != 0 && strings.HasPrefix(open[len(open)-1].closer, "`")
+		end, width := i+1, 0
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s):
+			r, size := utf8.DecodeRuneInString(s[i+1:])
+			end, width = i+1+size, utf16Len(r)
+		case inCode && strings.HasPrefix(s[i:], open[len(open)-1].closer):
+			end = i + len(open[len(open)-1].closer)
+			open = open[:len(open)-1]
+		case inCode:
+			end, width = scanGrapheme(s, i)
+		case len(open) != 0 && open[len(open)-1].at == i:
+			end = i + len(open[len(open)-1].closer)
+			open = open[:len(open)-1]
+		case strings.HasPrefix(s[i:], "```"):
+			end = i + 3
+			open = append(open, markdownV2Entity{closer: "```", at: -1})
+		case c == '`':
+			open = append(open, markdownV2Entity{closer: "`", at: -1})
+		case c == '[':
+			at, closer, ok := findLinkCloser(s, i+1)
+			if !ok {
+				width = 1
+				break
+			}
+			open = append(open, markdownV2Entity{closer: closer, at: at})
+		case strings.HasPrefix(s[i:], "__"), strings.HasPrefix(s[i:], "||"):
+			end = i + 2
+			toggle(s[i:end])
+		case c == '*' || c == '_' || c == '~':
+			toggle(s[i:end])
+		case c == '>' && (i == 0 || s[i-1] == '\n'):
+			// The marker of a quote.
+		default:
+			end, width = scanGrapheme(s, i)
+		}
+		if !visit(end, width, closers()) {
+			return
+		}
+		i = end
+	}
+}
+
+// findLinkCloser returns the offset and the markup of the "](url)" closing the
+// text of a link starting at i.
+func findLinkCloser(s string, i int) (int, string, bool) {
+	at := indexUnescaped(s, i, ']')
+	if at < 0 || !strings.HasPrefix(s[at:], "](") {
+		return 0, "", false
+	}
+	end := indexUnescaped(s, at+2, ')')
+	if end < 0 {
+		return 0, "", false
+	}
+	return at, s[at : end+1], true
+}
+
+// indexUnescaped returns the offset of the first c of s from i which isn't
+// escaped, or -1.
+func indexUnescaped(s string, i int, c byte) int {
+	for ; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case c:
+			return i
+		}
+	}
+	return -1
+}
+
+// scanGrapheme returns the end offset of the grapheme starting at i in s, and
+// its length in UTF-16 code units.
+func scanGrapheme(s string, i int) (int, int) {
+	r, size := utf8.DecodeRuneInString(s[i:])
+	end, width := i+size, utf16Len(r)
+	for end < len(s) {
+		next, size := utf8.DecodeRuneInString(s[end:])
+		if !isGraphemeExtend(next) && r != zeroWidthJoiner {
+			break
+		}
+		r = next
+		end, width = end+size, width+utf16Len(next)
+	}
+	return end, width
+}
+
+// utf16Len returns the number of UTF-16 code units encoding r.
+func utf16Len(r rune) int {
+	if r >= 0x10000 {
+		return 2
+	}
+	return 1
+}
+
+// markdownV2URLReplacer escapes the characters reserved inside the URL part of
+// a MarkdownV2 inline link.
+var markdownV2URLReplacer = strings.NewReplacer(
+	`\`, `\\`,
+	`)`, `\)`,
+)
+
+// escapeMarkdownV2URL escapes u so it can be used in a MarkdownV2 inline link.
+func escapeMarkdownV2URL(u string) string {
+	return markdownV2URLReplacer.Replace(u)
+}
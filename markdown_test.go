@@ -0,0 +1,155 @@
+package bots
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// isBalancedMarkdownV2 returns true if every entity of the MarkdownV2 text s is
+// closed.
+func isBalancedMarkdownV2(s string) bool {
+	var open []string
+	scanMarkdownV2(s, func(end, width int, closers []string) bool {
+		open = closers
+		return true
+	})
+	return len(open) == 0
+}
+
+func TestTruncateForTelegram(t *testing.T) {
+	long := strings.Repeat("a", 5000)
+	for _, c := range []struct {
+		name, text string
+		// prefix and suffix are expected around the cut.
+		prefix, suffix string
+	}{
+		{"short", "*bold* and [a link](https://example.com/)", "*bold* and [a link](https://example.com/)", ""},
+		{"plain", long, long[:MaxMessageLength-1], Ellipsis},
+		{"escapes", strings.Repeat(`\.`, 5000), strings.Repeat(`\.`, MaxMessageLength-1), Ellipsis},
+		{"bold", "*" + long + "*", "*" + long[:MaxMessageLength-1], Ellipsis + "*"},
+		{"nested", "*_" + long + "_*", "*_" + long[:MaxMessageLength-1], Ellipsis + "_*"},
+		{"link", "[" + long + "](https://example.com/\\))", "[" + long[:MaxMessageLength-1], Ellipsis + "](https://example.com/\\))"},
+		{"link after cut", long[:MaxMessageLength-2] + "[link](https://example.com/)", long[:MaxMessageLength-2] + "[l", Ellipsis + "](https://example.com/)"},
+		{"code", "`" + long + "`", "`" + long[:MaxMessageLength-1], Ellipsis + "`"},
+		{"pre", "```\n" + long + "\n```", "```\n" + long[:MaxMessageLength-2], Ellipsis + "```"},
+		{"underline and spoiler", "__||" + long + "||__", "__||" + long[:MaxMessageLength-1], Ellipsis + "||__"},
+		// Telegram counts UTF-16 code units, two per emoji.
+		{"emojis", strings.Repeat("😀", 3000), strings.Repeat("😀", (MaxMessageLength-1)/2), Ellipsis},
+		{"joined emojis", strings.Repeat("👩‍💻", 1000), strings.Repeat("👩‍💻", (MaxMessageLength-1)/5), Ellipsis},
+	} {
+		got := truncateForTelegram(c.text)
+		if !strings.HasPrefix(got, c.prefix) || !strings.HasSuffix(got, c.suffix) || len(got) != len(c.prefix)+len(c.suffix) {
+			t.Errorf("%s: truncateForTelegram() = %.40q...%q, want %.40q...%q", c.name, got, tail(got), c.prefix, c.suffix)
+		}
+		if n := markdownV2Length(got); n > MaxMessageLength {
+			t.Errorf("%s: truncated to %d, want at most %d", c.name, n, MaxMessageLength)
+		}
+		if !isBalancedMarkdownV2(got) {
+			t.Errorf("%s: %q has unclosed entities", c.name, tail(got))
+		}
+	}
+}
+
+// tail returns the end of s.
+func tail(s string) string {
+	if len(s) > 40 {
+		return s[len(s)-40:]
+	}
+	return s
+}
+
+func TestTruncateForTelegramStory(t *testing.T) {
+	// A verbose post of a few kilobytes, whose self-text and link are cut.
+	story := &Story{
+		ID:          1,
+		Type:        "story",
+		Title:       "Ask HN: " + strings.Repeat("What's up? ", 20),
+		SelfText:    strings.Repeat("<p>Some <i>italic</i> text, <code>code()</code> and <a href=\"https://example.com/\">a link</a>.", 200),
+		Score:       100,
+		Descendants: 10,
+		By:          "someone",
+	}
+	text, err := FormatStory(&Config{MessageTemplate: DefaultTemplate + "\n" + strings.Repeat("*bold* [link](https://example.com/) ", 200)}, story)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(text) < 2*MaxMessageLength {
+		t.Fatalf("text of %d bytes, want a longer one", len(text))
+	}
+	got := truncateForTelegram(text)
+	if n := markdownV2Length(got); n > MaxMessageLength {
+		t.Errorf("truncated to %d, want at most %d", n, MaxMessageLength)
+	}
+	if !isBalancedMarkdownV2(got) {
+		t.Errorf("%q has unclosed entities", tail(got))
+	}
+	if !strings.HasPrefix(text, strings.TrimSuffix(got[:len(got)/2], Ellipsis)) {
+		t.Errorf("truncated text isn't a prefix of the text")
+	}
+}
+
+func TestMarkdownV2Length(t *testing.T) {
+	for _, c := range []struct {
+		text string
+		want int
+	}{
+		{"", 0},
+		{"abc", 3},
+		{`a\.b`, 3},
+		{"*bold* _italic_ __underline__ ~strike~ ||spoiler||", 36},
+		{"[link](https://example.com/)", 4},
+		{"`a\\`b`", 3},
+		{"> quote", 6},
+		{"é😀", 3},
+	} {
+		if got := markdownV2Length(c.text); got != c.want {
+			t.Errorf("markdownV2Length(%q) = %d, want %d", c.text, got, c.want)
+		}
+	}
+}
+
+func TestEscapeMarkdownV2(t *testing.T) {
+	for _, c := range []struct {
+		text, want string
+	}{
+		{"", ""},
+		{"plain text", "plain text"},
+		{"_*[]()~`>#+-=|{}.!\\", "\\_\\*\\[\\]\\(\\)\\~\\`\\>\\#\\+\\-\\=\\|\\{\\}\\.\\!\\\\"},
+		{"C++ vs. C#", `C\+\+ vs\. C\#`},
+		{"Show HN: 1-click [beta] (v2.0)!", `Show HN: 1\-click \[beta\] \(v2\.0\)\!`},
+		{`a\_b`, `a\\\_b`},
+		{"é😀", "é😀"},
+	} {
+		got := escapeMarkdownV2(c.text)
+		if got != c.want {
+			t.Errorf("escapeMarkdownV2(%q) = %q, want %q", c.text, got, c.want)
+		}
+		// The escaped text is displayed as is.
+		if n, want := markdownV2Length(got), len(utf16.Encode([]rune(c.text))); n != want {
+			t.Errorf("escapeMarkdownV2(%q) displays %d characters, want %d", c.text, n, want)
+		}
+		if !isBalancedMarkdownV2(got) {
+			t.Errorf("escapeMarkdownV2(%q) = %q has unclosed entities", c.text, got)
+		}
+	}
+}
+
+func TestFormatStoryEscapesTitle(t *testing.T) {
+	story := &Story{
+		ID:    1,
+		Type:  "story",
+		Title: "Go 1.9 *released* [notes] (_finally_)!",
+		URL:   "https://example.com/a_(b)",
+	}
+	text, err := FormatStory(nil, story)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `*Go 1\.9 \*released\* \[notes\] \(\_finally\_\)\!*`; !strings.Contains(text, want) {
+		t.Errorf("FormatStory() = %q, want the title %q", text, want)
+	}
+	if !isBalancedMarkdownV2(text) {
+		t.Errorf("FormatStory() = %q has unclosed entities", text)
+	}
+}
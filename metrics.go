@@ -0,0 +1,164 @@
+package bots
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+)
+
+// Outcomes of the Telegram API calls counted by countTelegramOutcome.
+const (
+	OutcomeOK           = "ok"
+	OutcomeRateLimited  = "rate_limited"
+	OutcomeClientError  = "client_error"
+	OutcomeServerError  = "server_error"
+	OutcomeNetworkError = "network_error"
+)
+
+// telegramOutcomes is every outcome of the Telegram API calls.
+var telegramOutcomes = []string{OutcomeOK, OutcomeRateLimited, OutcomeClientError, OutcomeServerError, OutcomeNetworkError}
+
+// TelegramMetricsDays is the number of days of counters shown by /stats.
+const TelegramMetricsDays = 7
+
+// telegramMetricKey is the memcache key of the counter of the given outcome on
+// the given day, in UTC.
+func telegramMetricKey(day time.Time, outcome string) string {
+	return "TelegramCalls/" + day.UTC().Format("2006-01-02") + "/" + outcome
+}
+
+// countTelegramOutcome increments the counter of the given outcome today. The
+// counters live in memcache, so they're cheap but may be evicted, and errors
+// are only logged.
+func countTelegramOutcome(ctx context.Context, outcome string) {
+	if _, err := memcache.Increment(ctx, telegramMetricKey(time.Now(), outcome), 1, 0); err != nil {
+		log.Warningf(ctx, "counting %s Telegram call: %v", outcome, err)
+	}
+	countEvent(ctx, telegramCallsCounter(outcome), 1)
+}
+
+// Counters of the events of the bot since the counters were last evicted from
+// memcache, exposed by /metrics.
+const (
+	CounterPolls   = "polls_total"
+	CounterPosted  = "stories_posted_total"
+	CounterEdits   = "edits_total"
+	CounterDeletes = "deletes_total"
+)
+
+// telegramCallsCounter is the counter of the Telegram API calls of the given
+// outcome.
+func telegramCallsCounter(outcome string) string {
+	return `telegram_calls_total{outcome="` + outcome + `"}`
+}
+
+// counterKey is the memcache key of the counter of the given name.
+func counterKey(name string) string {
+	return "Counter/" + name
+}
+
+// countEvent adds n to the counter of the given name. Like the Telegram
+// outcomes, errors are only logged.
+func countEvent(ctx context.Context, name string, n int64) {
+	if _, err := memcache.Increment(ctx, counterKey(name), n, 0); err != nil {
+		log.Warningf(ctx, "counting %s: %v", name, err)
+	}
+}
+
+// TelegramCallCounts returns the counters of the Telegram API calls of the last
+// TelegramMetricsDays days up to now, by day then outcome. Days and outcomes
+// without calls are left out.
+func TelegramCallCounts(ctx context.Context, now time.Time) (map[string]map[string]uint64, error) {
+	var keys []string
+	for i := 0; i < TelegramMetricsDays; i++ {
+		for _, outcome := range telegramOutcomes {
+			keys = append(keys, telegramMetricKey(now.AddDate(0, 0, -i), outcome))
+		}
+	}
+	items, err := memcache.GetMulti(ctx, keys)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	counts := make(map[string]map[string]uint64)
+	for i := 0; i < TelegramMetricsDays; i++ {
+		day := now.AddDate(0, 0, -i).UTC().Format("2006-01-02")
+		for _, outcome := range telegramOutcomes {
+			item, ok := items[telegramMetricKey(now.AddDate(0, 0, -i), outcome)]
+			if !ok {
+				continue
+			}
+			// Incremented values are stored as decimal strings.
+			n, err := strconv.ParseUint(string(item.Value), 10, 64)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			if counts[day] == nil {
+				counts[day] = make(map[string]uint64)
+			}
+			counts[day][outcome] = n
+		}
+	}
+	return counts, nil
+}
+
+// MetricsPrefix prefixes the names of the metrics exposed by /metrics.
+const MetricsPrefix = "yegle_bots_"
+
+// metricsHandler exposes the counters of the bot, and the number of tracked
+// stories, in the Prometheus text format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	names := []string{CounterPolls, CounterPosted, CounterEdits, CounterDeletes}
+	for _, outcome := range telegramOutcomes {
+		names = append(names, telegramCallsCounter(outcome))
+	}
+	var keys []string
+	for _, name := range names {
+		keys = append(keys, counterKey(name))
+	}
+	items, err := memcache.GetMulti(ctx, keys)
+	if err != nil {
+		loge(ctx, errors.WithStack(err))
+		http.Error(w, "memcache error", http.StatusInternalServerError)
+		return
+	}
+	tracked, err := datastore.NewQuery("Story").KeysOnly().Count(ctx)
+	if err != nil {
+		loge(ctx, errors.WithStack(err))
+		http.Error(w, "datastore error", http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	typed := make(StringSet)
+	for _, name := range names {
+		// Evicted or never incremented counters are zero.
+		var n uint64
+		if item, ok := items[counterKey(name)]; ok {
+			n, _ = strconv.ParseUint(string(item.Value), 10, 64)
+		}
+		if family := strings.SplitN(name, "{", 2)[0]; typed.Add(family) {
+			fmt.Fprintf(&buf, "# TYPE %s%s counter\n", MetricsPrefix, family)
+		}
+		fmt.Fprintf(&buf, "%s%s %d\n", MetricsPrefix, name, n)
+	}
+	fmt.Fprintf(&buf, "# TYPE %stracked_stories gauge\n", MetricsPrefix)
+	fmt.Fprintf(&buf, "%stracked_stories %d\n", MetricsPrefix, tracked)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if _, err := buf.WriteTo(w); err != nil {
+		loge(ctx, errors.WithStack(err))
+	}
+}
@@ -0,0 +1,94 @@
+package bots
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/appengine/log"
+)
+
+// DefaultCommentMilestones is the default of Config.CommentMilestones.
+var DefaultCommentMilestones = []int64{100, 500, 1000}
+
+// DefaultScoreMilestones is the default of Config.ScoreMilestones.
+var DefaultScoreMilestones = []int64{100, 500, 1000}
+
+// MilestoneReaction is the reaction set on the message of a story crossing a
+// score milestone.
+const MilestoneReaction = "🔥"
+
+// reachedMilestone returns the highest of milestones that comments reached, or
+// zero if none was reached.
+func reachedMilestone(milestones []int64, comments int64) int64 {
+	var reached int64
+	for _, m := range milestones {
+		if m > 0 && comments >= m && m > reached {
+			reached = m
+		}
+	}
+	return reached
+}
+
+// postMilestone posts a reply to the message of the story when it crossed a
+// comment milestone since the last one it was notified of, and returns true if
+// LastMilestone changed. A failed reply is only logged, and tried again by the
+// next edit.
+func (s *Story) postMilestone(ctx context.Context, cfg *Config) bool {
+	milestone := reachedMilestone(cfg.CommentMilestones, s.Descendants)
+	if milestone <= s.LastMilestone {
+		return false
+	}
+	text := fmt.Sprintf("💬 %d+ comments on %s", milestone, s.Title)
+	_, err := postMessage(ctx, SendMessageRequest{
+		ChatID:                s.MessageChatID(),
+		MessageThreadID:       s.MessageThreadID,
+		Text:                  fmt.Sprintf("[%s](%s)", escapeMarkdownV2(text), escapeMarkdownV2URL(s.CommentsLink())),
+		ParseMode:             "MarkdownV2",
+		DisableWebPagePreview: true,
+		ReplyToMessageID:      s.MessageID,
+	})
+	if err != nil {
+		loge(ctx, err)
+		return false
+	}
+	log.Infof(ctx, "%d reached %d comments", s.ID, milestone)
+	s.LastMilestone = milestone
+	return true
+}
+
+// celebrate posts the comment milestone and sets the score milestone reaction
+// of the story, if due, and returns true if the story changed.
+func (s *Story) celebrate(ctx context.Context, cfg *Config) bool {
+	replied := s.postMilestone(ctx, cfg)
+	reacted := s.reactMilestone(ctx, cfg)
+	return replied || reacted
+}
+
+// reactMilestone sets MilestoneReaction on the message of the story when it
+// crossed a score milestone since the last one it reacted to, with
+// Config.ReactOnMilestone, and returns true if LastReaction changed. Chats not
+// permitting the reaction skip the milestone, other failures are only logged,
+// and tried again by the next edit.
+func (s *Story) reactMilestone(ctx context.Context, cfg *Config) bool {
+	if !cfg.ReactOnMilestone {
+		return false
+	}
+	milestone := reachedMilestone(cfg.ScoreMilestones, s.Score)
+	if milestone <= s.LastReaction {
+		return false
+	}
+	err := callTelegram(ctx, "setMessageReaction", SetMessageReactionRequest{
+		ChatID:    s.MessageChatID(),
+		MessageID: s.MessageID,
+		Reaction:  []ReactionType{{Type: "emoji", Emoji: MilestoneReaction}},
+	}, nil)
+	if e, ok := asTelegramError(err); ok && e.IsReactionUnavailable() {
+		log.Warningf(ctx, "ignoring %v", e)
+	} else if err != nil {
+		loge(ctx, err)
+		return false
+	}
+	log.Infof(ctx, "%d reached a score of %d", s.ID, milestone)
+	s.LastReaction = milestone
+	return true
+}
@@ -0,0 +1,86 @@
+package bots
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/appengine/datastore"
+)
+
+// OpsAlertWindow is how long an alert keeps identical ones from being sent.
+const OpsAlertWindow = time.Hour
+
+// errAlertSent is returned when an identical alert was sent within
+// OpsAlertWindow.
+var errAlertSent = errors.New("alert already sent")
+
+// OpsAlert marks an alert as sent.
+type OpsAlert struct {
+	Message string `datastore:",noindex"`
+	SentAt  time.Time
+}
+
+// GetOpsAlertKey get a datastore key for the alerts of the given message sent
+// to the given ops chat.
+func GetOpsAlertKey(ctx context.Context, opsChatID, message string) *datastore.Key {
+	h := fnv.New64a()
+	h.Write([]byte(opsChatID + "\x00" + message))
+	return datastore.NewKey(ctx, "OpsAlert", strconv.FormatUint(h.Sum64(), 16), 0, nil)
+}
+
+// maybeAlertOps sends err to the ops chat of the chat of chatID, unless there
+// is none or an identical error was sent to it within OpsAlertWindow. Failures
+// to alert are only logged.
+func maybeAlertOps(ctx context.Context, err error, chatID string) {
+	opsChatID := getOpsChatID(ctx, chatID)
+	if opsChatID == "" {
+		return
+	}
+	// The cause has no stack, so identical errors have identical messages.
+	message := errors.Cause(err).Error()
+	now := time.Now()
+	key := GetOpsAlertKey(ctx, opsChatID, message)
+	txErr := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		var alert OpsAlert
+		err := datastore.Get(ctx, key, &alert)
+		if err == nil && now.Sub(alert.SentAt) < OpsAlertWindow {
+			return errAlertSent
+		}
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return errors.WithStack(err)
+		}
+		_, err = datastore.Put(ctx, key, &OpsAlert{Message: message, SentAt: now})
+		return errors.WithStack(err)
+	}, nil)
+	if txErr != nil {
+		if errors.Cause(txErr) != errAlertSent {
+			loge(ctx, txErr)
+		}
+		return
+	}
+
+	// Alerts are sent even when the failing chat is in dry run.
+	_, err = postMessage(withDryRun(ctx, false), SendMessageRequest{
+		ChatID: opsChatID,
+		Text:   fmt.Sprintf("⚠️ %s", message),
+	})
+	if err != nil {
+		loge(ctx, err)
+	}
+}
+
+// getOpsChatID returns the OpsChatID of the config of chatID, or OPS_CHAT_ID
+// when it has none, chatID is empty or its config fails to load.
+func getOpsChatID(ctx context.Context, chatID string) string {
+	if chatID != "" {
+		if cfg, err := LoadConfig(ctx, chatID); err == nil && cfg.OpsChatID != "" {
+			return cfg.OpsChatID
+		}
+	}
+	return os.Getenv("OPS_CHAT_ID")
+}
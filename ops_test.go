@@ -0,0 +1,54 @@
+package bots
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestMaybeAlertOps(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	server := newFakeServer(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"ok":true,"result":{"message_id":42}}`)
+	})
+	defer server.Close()
+	defer os.Setenv("OPS_CHAT_ID", os.Getenv("OPS_CHAT_ID"))
+	os.Setenv("OPS_CHAT_ID", "@envops")
+
+	cfg := &Config{ChatID: "@chat", OpsChatID: "@ops"}
+	if _, err := datastore.Put(ctx, GetConfigKey(ctx, cfg.ChatID), cfg); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		chatID string
+		want   string
+	}{
+		{"@chat", "@ops"},
+		// The identical alert isn't sent again within OpsAlertWindow.
+		{"@chat", ""},
+		// The chats without an OpsChatID alert OPS_CHAT_ID.
+		{"@other", "@envops"},
+		// The tasks of no chat too, the alert was already sent there.
+		{"", ""},
+	} {
+		server.reset()
+		maybeAlertOps(ctx, errors.New("something failed"), c.chatID)
+		var got string
+		for _, r := range server.TelegramRequests() {
+			var req SendMessageRequest
+			if err := json.Unmarshal(r.Body, &req); err != nil {
+				t.Fatal(err)
+			}
+			got += req.ChatID
+		}
+		if got != c.want {
+			t.Errorf("maybeAlertOps() of %q alerted %q, want %q", c.chatID, got, c.want)
+		}
+	}
+}
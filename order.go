@@ -0,0 +1,49 @@
+package bots
+
+import "sort"
+
+// Orders of the entries of the digests and combined posts, see
+// Config.DigestOrder.
+const (
+	// DigestOrderScore lists the highest scores first.
+	DigestOrderScore = "score"
+	// DigestOrderRank lists the stories in the order of their feed, the
+	// stories of unknown rank last.
+	DigestOrderRank = "rank"
+	// DigestOrderRecent lists the latest submissions first.
+	DigestOrderRecent = "recent"
+)
+
+// isValidDigestOrder returns true if order is empty or one of the digest orders.
+func isValidDigestOrder(order string) bool {
+	switch order {
+	case "", DigestOrderScore, DigestOrderRank, DigestOrderRecent:
+		return true
+	}
+	return false
+}
+
+// sortStories sorts stories in the given order, one of the digest orders. The
+// sort is stable, so stories comparing equal keep their order, and an empty or
+// unknown order leaves them as is.
+func sortStories(stories []Story, order string) {
+	var less func(a, b *Story) bool
+	switch order {
+	case DigestOrderScore:
+		less = func(a, b *Story) bool { return a.Score > b.Score }
+	case DigestOrderRank:
+		less = func(a, b *Story) bool {
+			if a.Rank == 0 || b.Rank == 0 {
+				return b.Rank == 0 && a.Rank != 0
+			}
+			return a.Rank < b.Rank
+		}
+	case DigestOrderRecent:
+		less = func(a, b *Story) bool { return a.HNTime.After(b.HNTime) }
+	default:
+		return
+	}
+	sort.SliceStable(stories, func(i, j int) bool {
+		return less(&stories[i], &stories[j])
+	})
+}
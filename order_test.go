@@ -0,0 +1,59 @@
+package bots
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSortStories(t *testing.T) {
+	now := time.Now()
+	stories := []Story{
+		{ID: 1, Score: 50, Rank: 3, HNTime: now.Add(-3 * time.Hour)},
+		{ID: 2, Score: 200, Rank: 0, HNTime: now.Add(-time.Hour)},
+		{ID: 3, Score: 100, Rank: 1, HNTime: now.Add(-5 * time.Hour)},
+		{ID: 4, Score: 200, Rank: 2, HNTime: now.Add(-2 * time.Hour)},
+		{ID: 5, Score: 10, Rank: 0},
+	}
+	for _, c := range []struct {
+		order string
+		want  []int64
+	}{
+		{"", []int64{1, 2, 3, 4, 5}},
+		{"unknown", []int64{1, 2, 3, 4, 5}},
+		// Equal scores keep their order.
+		{DigestOrderScore, []int64{2, 4, 3, 1, 5}},
+		// Unknown ranks go last, in their order.
+		{DigestOrderRank, []int64{3, 4, 1, 2, 5}},
+		// Unknown submission times go last.
+		{DigestOrderRecent, []int64{2, 4, 1, 3, 5}},
+	} {
+		sorted := append([]Story(nil), stories...)
+		sortStories(sorted, c.order)
+		var got []int64
+		for _, s := range sorted {
+			got = append(got, s.ID)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("sortStories(%q) = %v, want %v", c.order, got, c.want)
+		}
+	}
+}
+
+func TestIsValidDigestOrder(t *testing.T) {
+	for _, c := range []struct {
+		order string
+		want  bool
+	}{
+		{"", true},
+		{DigestOrderScore, true},
+		{DigestOrderRank, true},
+		{DigestOrderRecent, true},
+		{"Score", false},
+		{"comments", false},
+	} {
+		if got := isValidDigestOrder(c.order); got != c.want {
+			t.Errorf("isValidDigestOrder(%q) = %v, want %v", c.order, got, c.want)
+		}
+	}
+}
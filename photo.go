@@ -0,0 +1,91 @@
+package bots
+
+import (
+	"context"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+
+	"github.com/pkg/errors"
+	"google.golang.org/appengine/log"
+)
+
+// MaxCaptionLength is the max length of the caption of a photo message, see
+// markdownV2Length. Stories whose text is longer are sent as text messages, and
+// the captions growing longer are truncated by the edits.
+const MaxCaptionLength = 1024
+
+// maxOGPageSize caps the part of an article read looking for its image. The
+// meta tags are in the head, at the start of the page.
+const maxOGPageSize = 256 << 10
+
+// ogImageRegexps match the og:image meta tags, whatever the order of their
+// attributes.
+var ogImageRegexps = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)<meta[^>]+property=["']og:image["'][^>]+content=["']([^"']+)["']`),
+	regexp.MustCompile(`(?i)<meta[^>]+content=["']([^"']+)["'][^>]+property=["']og:image["']`),
+}
+
+// fetchOGImage returns the absolute URL of the OpenGraph image of the page at
+// pageURL, or false when it has none or can't be fetched.
+func fetchOGImage(ctx context.Context, pageURL string) (string, bool) {
+	resp, err := httpGet(ctx, pageURL)
+	if err != nil {
+		log.Infof(ctx, "fetching the image of %s: %v", pageURL, err)
+		return "", false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", false
+	}
+	page, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxOGPageSize))
+	if err != nil {
+		return "", false
+	}
+
+	for _, re := range ogImageRegexps {
+		m := re.FindSubmatch(page)
+		if m == nil {
+			continue
+		}
+		image, err := url.Parse(html.UnescapeString(string(m[1])))
+		if err != nil {
+			return "", false
+		}
+		base, err := url.Parse(pageURL)
+		if err != nil {
+			return "", false
+		}
+		image = base.ResolveReference(image)
+		if image.Scheme != "http" && image.Scheme != "https" {
+			return "", false
+		}
+		return image.String(), true
+	}
+	return "", false
+}
+
+// sendPhoto sends the message of the story as photo, with text as caption, and
+// returns the ID of the message. The message is silent when silent is true.
+func (s *Story) sendPhoto(ctx context.Context, photo, text string, silent bool) (int64, error) {
+	if markdownV2Length(text) > MaxCaptionLength {
+		return 0, errors.Errorf("caption of %d too long", s.ID)
+	}
+	markup := s.GetReplyMarkup()
+	var result Result
+	err := callTelegram(ctx, "sendPhoto", SendPhotoRequest{
+		ChatID:              s.MessageChatID(),
+		MessageThreadID:     s.MessageThreadID,
+		Photo:               photo,
+		Caption:             text,
+		ParseMode:           "MarkdownV2",
+		DisableNotification: silent,
+		ReplyMarkup:         &markup,
+	}, &result)
+	if err != nil {
+		return 0, err
+	}
+	return result.MessageID, nil
+}
@@ -0,0 +1,94 @@
+package bots
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/delay"
+	"google.golang.org/appengine/log"
+)
+
+// PinnedStory is the story whose message is pinned in a chat.
+type PinnedStory struct {
+	ItemID    int64
+	MessageID int64
+}
+
+// GetPinnedStoryKey get a datastore key for the pinned story of the given chat.
+func GetPinnedStoryKey(ctx context.Context, chatID string) *datastore.Key {
+	return datastore.NewKey(ctx, "PinnedStory", "pinned", 0, GetConfigKey(ctx, chatID))
+}
+
+var pinTopFunc = delay.Func("pinTop", func(ctx context.Context, chatID string, itemID int64) {
+	fields := map[string]interface{}{"method": "pinTop", "item_id": itemID, "chat_id": chatID}
+	cfg, err := LoadConfig(ctx, chatID)
+	if err != nil {
+		logeWith(ctx, err, fields)
+		return
+	}
+	err = pinTop(withDryRun(ctx, cfg.DryRun), chatID, itemID)
+	if e, ok := asTelegramError(err); ok && e.IsChatGone() {
+		err = disableChat(ctx, chatID, e.Description)
+	}
+	if err != nil {
+		logeWith(ctx, err, fields)
+	}
+})
+
+// pinTop pins the message of the given story in the chat, replacing the
+// previously pinned one.
+func pinTop(ctx context.Context, chatID string, itemID int64) error {
+	key := GetPinnedStoryKey(ctx, chatID)
+	var pinned PinnedStory
+	if err := datastore.Get(ctx, key, &pinned); err != nil && err != datastore.ErrNoSuchEntity {
+		return errors.WithStack(err)
+	}
+	if pinned.ItemID == itemID {
+		return nil
+	}
+
+	story, err := NewFromDatastore(ctx, SourceHN, chatID, itemID)
+	if errors.Cause(err) == datastore.ErrNoSuchEntity {
+		log.Infof(ctx, "top story %d not posted in %s yet", itemID, chatID)
+		return nil
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if story.PostedChatID != "" {
+		log.Infof(ctx, "top story %d posted in fallback %s", itemID, story.PostedChatID)
+		return nil
+	}
+
+	err = callTelegram(ctx, "pinChatMessage", PinChatMessageRequest{
+		ChatID:              chatID,
+		MessageID:           story.MessageID,
+		DisableNotification: true,
+	}, nil)
+	if err != nil {
+		// Someone manually deleted the message, wait for the next top story.
+		if e, ok := asTelegramError(err); ok && e.IsMessageNotFound() {
+			log.Warningf(ctx, "ignoring %v", e)
+			return nil
+		}
+		return err
+	}
+
+	if pinned.MessageID != 0 {
+		err := callTelegram(ctx, "unpinChatMessage", UnpinChatMessageRequest{
+			ChatID:    chatID,
+			MessageID: pinned.MessageID,
+		}, nil)
+		if e, ok := asTelegramError(err); err != nil && !(ok && e.IsMessageNotFound()) {
+			loge(ctx, err)
+		}
+	}
+
+	pinned = PinnedStory{ItemID: itemID, MessageID: story.MessageID}
+	if _, err := datastore.Put(ctx, key, &pinned); err != nil {
+		return errors.WithStack(err)
+	}
+	log.Infof(ctx, "%d (messageID: %d) pinned in %s", itemID, story.MessageID, chatID)
+	return nil
+}
@@ -0,0 +1,143 @@
+package bots
+
+import (
+	"context"
+	"hash/fnv"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/delay"
+	"google.golang.org/appengine/log"
+)
+
+// PinnedDigest is the pinned message of a chat with Config.PinDigest, listing
+// the current top stories. It's edited in place by each poll.
+type PinnedDigest struct {
+	MessageID   int64
+	ContentHash string `datastore:",noindex"`
+	UpdatedAt   time.Time
+}
+
+// GetPinnedDigestKey get a datastore key for the pinned digest of the given
+// chat.
+func GetPinnedDigestKey(ctx context.Context, chatID string) *datastore.Key {
+	return datastore.NewKey(ctx, "PinnedDigest", "digest", 0, GetConfigKey(ctx, chatID))
+}
+
+var pinDigestFunc = delay.Func("pinDigest", func(ctx context.Context, chatID string, ids []int64) {
+	fields := map[string]interface{}{"method": "pinDigest", "chat_id": chatID}
+	cfg, err := LoadConfig(ctx, chatID)
+	if err != nil {
+		logeWith(ctx, err, fields)
+		return
+	}
+	err = pinDigest(withDryRun(ctx, cfg.DryRun), cfg, ids)
+	if e, ok := asTelegramError(err); ok && e.IsChatGone() {
+		err = disableChat(ctx, chatID, e.Description)
+	}
+	if err != nil {
+		// The next poll updates the digest anyway.
+		if _, ok := asRateLimitError(err); ok {
+			log.Warningf(ctx, "digest of %s not updated: %v", chatID, err)
+			return
+		}
+		logeWith(ctx, err, fields)
+	}
+})
+
+// pinDigest updates the pinned digest of the chat of cfg to list the stories of
+// the given IDs of the top feed, in its DigestOrder. The digest is posted and pinned when the
+// chat has none yet, or when its message was deleted. Nothing is sent when the
+// digest is unchanged since the last update.
+func pinDigest(ctx context.Context, cfg *Config, ids []int64) error {
+	chatID := cfg.ChatID
+	var stories []Story
+	for i, id := range ids {
+		story := Story{ID: id, ChatID: chatID, Feed: FeedTop, Source: SourceHN, Rank: int64(i + 1)}
+		if err := story.FillMissingFields(ctx); err != nil {
+			if !isIgnored(err) {
+				loge(ctx, err)
+			}
+			continue
+		}
+		if story.Deleted || story.Dead {
+			continue
+		}
+		stories = append(stories, story)
+	}
+	if len(stories) == 0 {
+		return nil
+	}
+	sortStories(stories, cfg.DigestOrder)
+	text := formatDigest("Top stories now", stories, time.Now())
+	h := fnv.New64a()
+	h.Write([]byte(text))
+	hash := strconv.FormatUint(h.Sum64(), 16)
+
+	key := GetPinnedDigestKey(ctx, chatID)
+	var pinned PinnedDigest
+	if err := datastore.Get(ctx, key, &pinned); err != nil && err != datastore.ErrNoSuchEntity {
+		return errors.WithStack(err)
+	}
+	if pinned.MessageID != 0 && pinned.ContentHash == hash {
+		log.Debugf(ctx, "digest of %s not modified", chatID)
+		return nil
+	}
+
+	if pinned.MessageID != 0 {
+		err := callTelegram(ctx, "editMessageText", EditMessageTextRequest{
+			ChatID:                chatID,
+			MessageID:             pinned.MessageID,
+			Text:                  text,
+			ParseMode:             "MarkdownV2",
+			DisableWebPagePreview: true,
+		}, nil)
+		e, ok := asTelegramError(err)
+		switch {
+		case err == nil:
+		case ok && e.IsNotModified():
+			// Only the hash was lost, e.g. when the last save failed.
+			log.Debugf(ctx, "message of the digest of %s not modified", chatID)
+		case ok && e.IsMessageNotFound():
+			// Someone manually deleted the message, post a new one.
+			log.Warningf(ctx, "ignoring %v", e)
+			pinned.MessageID = 0
+		default:
+			return err
+		}
+	}
+
+	if pinned.MessageID == 0 {
+		messageID, err := postMessage(ctx, SendMessageRequest{
+			ChatID:                chatID,
+			MessageThreadID:       cfg.MessageThreadID,
+			Text:                  text,
+			ParseMode:             "MarkdownV2",
+			DisableWebPagePreview: true,
+			DisableNotification:   true,
+		})
+		if err != nil {
+			return err
+		}
+		// The message is saved even when the pin fails, so the next poll
+		// edits it rather than posting another one.
+		err = callTelegram(ctx, "pinChatMessage", PinChatMessageRequest{
+			ChatID:              chatID,
+			MessageID:           messageID,
+			DisableNotification: true,
+		}, nil)
+		if err != nil {
+			loge(ctx, err)
+		}
+		pinned.MessageID = messageID
+		log.Infof(ctx, "digest (messageID: %d) pinned in %s", messageID, chatID)
+	}
+
+	pinned.ContentHash, pinned.UpdatedAt = hash, time.Now()
+	if _, err := datastore.Put(ctx, key, &pinned); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
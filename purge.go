@@ -0,0 +1,110 @@
+package bots
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// PurgeBatchSize is the number of stories handled by one /purge request.
+const PurgeBatchSize = 200
+
+// PurgeResponse is the response of the /purge endpoint.
+type PurgeResponse struct {
+	Scheduled int64 `json:"scheduled"`
+	// Cursor is given back to /purge to handle the next stories, empty when
+	// all of them were handled and the chat state was removed.
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// purgeHandler schedules the deletes of the messages of the stories posted in
+// the chat parameter, at most PurgeBatchSize of them, and continues from the
+// cursor parameter. Once all of them are scheduled, the config of the chat and
+// the entities under it are deleted, so the chat is no longer polled. Stories
+// saved before multiple chats were supported have no ChatID property, and are
+// left to the cleanup.
+func purgeHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	ctx := appengine.NewContext(r)
+
+	chatID := r.FormValue("chat")
+	if chatID == "" {
+		http.Error(w, "missing chat", http.StatusBadRequest)
+		return
+	}
+	q := datastore.NewQuery("Story").Filter("ChatID =", chatID).Limit(PurgeBatchSize)
+	if c := r.FormValue("cursor"); c != "" {
+		cursor, err := datastore.DecodeCursor(c)
+		if err != nil {
+			http.Error(w, "invalid cursor", http.StatusBadRequest)
+			return
+		}
+		q = q.Start(cursor)
+	}
+
+	var response PurgeResponse
+	var tasks []func()
+	it := q.Run(ctx)
+	n := 0
+	for {
+		var story Story
+		_, err := it.Next(&story)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			loge(ctx, errors.WithStack(err))
+			http.Error(w, "datastore error", http.StatusInternalServerError)
+			return
+		}
+		n++
+		// Stories being sent have no message yet, a later purge gets them.
+		if story.MessageID == 0 {
+			continue
+		}
+		id, messageID, source := story.ID, story.MessageID, story.Source
+		tasks = append(tasks, func() {
+			if err := deleteMessageFunc.Call(ctx, id, messageID, chatID, source); err != nil {
+				loge(ctx, errors.WithStack(err))
+				return
+			}
+			atomic.AddInt64(&response.Scheduled, 1)
+		})
+	}
+	runBounded(ctx, MaxConcurrency, tasks)
+
+	if n == PurgeBatchSize {
+		cursor, err := it.Cursor()
+		if err != nil {
+			loge(ctx, errors.WithStack(err))
+			http.Error(w, "datastore error", http.StatusInternalServerError)
+			return
+		}
+		response.Cursor = cursor.String()
+	} else if err := deleteChatState(ctx, chatID); err != nil {
+		loge(ctx, err)
+		http.Error(w, "datastore error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// deleteChatState deletes the config of the chat and the entities under it,
+// e.g. its pinned story and digest markers.
+func deleteChatState(ctx context.Context, chatID string) error {
+	// Kindless ancestor queries include the ancestor itself.
+	keys, err := datastore.NewQuery("").Ancestor(GetConfigKey(ctx, chatID)).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(datastore.DeleteMulti(ctx, keys))
+}
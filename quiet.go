@@ -0,0 +1,56 @@
+package bots
+
+import (
+	"fmt"
+	"time"
+)
+
+// QuietSpread is the window the sends deferred by the quiet hours are spread
+// over once they end.
+const QuietSpread = 10 * time.Minute
+
+// QuietHoursError is returned by SendMessage during the quiet hours of a chat
+// with Config.QuietDefer. The send should be retried after RetryAfter.
+type QuietHoursError struct {
+	ChatID     string
+	RetryAfter time.Duration
+}
+
+func (e *QuietHoursError) Error() string {
+	return fmt.Sprintf("quiet hours of %s, retry after %v", e.ChatID, e.RetryAfter)
+}
+
+// isValidHour returns true if h is an hour of the day.
+func isValidHour(h int64) bool {
+	return h >= 0 && h < 24
+}
+
+// QuietUntil returns when the quiet hours of the chat end, and true if now is
+// within them. The window starts at QuietStart and ends at QuietEnd, in the
+// local time of Timezone, and wraps around midnight when QuietEnd is before
+// QuietStart, e.g. 22 to 7. There are no quiet hours when both are equal.
+func (c *Config) QuietUntil(now time.Time) (time.Time, bool) {
+	if c.QuietStart == c.QuietEnd {
+		return time.Time{}, false
+	}
+	loc := c.location
+	if loc == nil {
+		loc = time.UTC
+	}
+	local := now.In(loc)
+	h := int64(local.Hour())
+	var quiet bool
+	if c.QuietStart < c.QuietEnd {
+		quiet = h >= c.QuietStart && h < c.QuietEnd
+	} else {
+		quiet = h >= c.QuietStart || h < c.QuietEnd
+	}
+	if !quiet {
+		return time.Time{}, false
+	}
+	end := time.Date(local.Year(), local.Month(), local.Day(), int(c.QuietEnd), 0, 0, 0, loc)
+	if !end.After(local) {
+		end = time.Date(local.Year(), local.Month(), local.Day()+1, int(c.QuietEnd), 0, 0, 0, loc)
+	}
+	return end, true
+}
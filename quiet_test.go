@@ -0,0 +1,89 @@
+package bots
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestQuietUntil(t *testing.T) {
+	tokyo := time.FixedZone("JST", 9*60*60)
+	at := func(day, hour, min int, loc *time.Location) time.Time {
+		return time.Date(2017, time.October, day, hour, min, 0, 0, loc)
+	}
+	for _, c := range []struct {
+		name       string
+		start, end int64
+		loc        *time.Location
+		now        time.Time
+		wantQuiet  bool
+		wantEnd    time.Time
+	}{
+		{"none", 0, 0, nil, at(10, 3, 0, time.UTC), false, time.Time{}},
+		{"same hours", 8, 8, nil, at(10, 8, 0, time.UTC), false, time.Time{}},
+		{"within", 1, 6, nil, at(10, 3, 0, time.UTC), true, at(10, 6, 0, time.UTC)},
+		{"at the start", 1, 6, nil, at(10, 1, 0, time.UTC), true, at(10, 6, 0, time.UTC)},
+		{"at the end", 1, 6, nil, at(10, 6, 0, time.UTC), false, time.Time{}},
+		{"before", 1, 6, nil, at(10, 0, 59, time.UTC), false, time.Time{}},
+		// 22 to 7 wraps around midnight.
+		{"wrapped before midnight", 22, 7, nil, at(10, 23, 30, time.UTC), true, at(11, 7, 0, time.UTC)},
+		{"wrapped after midnight", 22, 7, nil, at(11, 2, 0, time.UTC), true, at(11, 7, 0, time.UTC)},
+		{"wrapped at the start", 22, 7, nil, at(10, 22, 0, time.UTC), true, at(11, 7, 0, time.UTC)},
+		{"wrapped outside", 22, 7, nil, at(10, 12, 0, time.UTC), false, time.Time{}},
+		{"wrapped at the end", 22, 7, nil, at(11, 7, 0, time.UTC), false, time.Time{}},
+		{"month end", 22, 7, nil, time.Date(2017, time.October, 31, 23, 0, 0, 0, time.UTC), true, time.Date(2017, time.November, 1, 7, 0, 0, 0, time.UTC)},
+		// 14:00 UTC is 23:00 in Tokyo.
+		{"timezone", 22, 7, tokyo, at(10, 14, 0, time.UTC), true, at(11, 7, 0, tokyo)},
+		{"timezone outside", 22, 7, tokyo, at(10, 23, 0, time.UTC), false, time.Time{}},
+	} {
+		cfg := &Config{QuietStart: c.start, QuietEnd: c.end, location: c.loc}
+		end, quiet := cfg.QuietUntil(c.now)
+		if quiet != c.wantQuiet || !end.Equal(c.wantEnd) {
+			t.Errorf("%s: QuietUntil(%v) = %v, %v, want %v, %v", c.name, c.now, end, quiet, c.wantEnd, c.wantQuiet)
+		}
+	}
+}
+
+func TestSendMessageQuietHours(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	server := newFakeServer(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"ok":true,"result":{"message_id":42}}`)
+	})
+	defer server.Close()
+	// The quiet hours started this hour.
+	hour := int64(time.Now().UTC().Hour())
+	for _, c := range []struct {
+		name       string
+		deferSends bool
+		wantSilent bool
+	}{
+		{"silent", false, true},
+		{"deferred", true, false},
+	} {
+		server.reset()
+		cfg := &Config{ChatID: "@chat", QuietStart: hour, QuietEnd: (hour + 2) % 24, QuietDefer: c.deferSends}
+		s := &Story{ID: 1, Type: "story", Title: "A story", Score: 100, ChatID: "@chat", missingFieldsLoaded: true}
+		err := s.SendMessage(ctx, cfg)
+		reqs := server.TelegramRequests()
+		if c.deferSends {
+			e, ok := err.(*QuietHoursError)
+			if !ok || e.RetryAfter <= time.Hour || e.RetryAfter > 2*time.Hour+QuietSpread || len(reqs) != 0 {
+				t.Errorf("%s: SendMessage() = %v with %d Telegram requests, want a QuietHoursError", c.name, err, len(reqs))
+			}
+			continue
+		}
+		if err != nil || len(reqs) != 1 {
+			t.Fatalf("%s: SendMessage() = %v with %d Telegram requests", c.name, err, len(reqs))
+		}
+		var payload SendMessageRequest
+		if err := json.Unmarshal(reqs[0].Body, &payload); err != nil {
+			t.Fatal(err)
+		}
+		if payload.DisableNotification != c.wantSilent {
+			t.Errorf("%s: disable_notification = %v, want %v", c.name, payload.DisableNotification, c.wantSilent)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package bots
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/appengine/datastore"
+)
+
+// PostCapWindow is the rolling window of Config.MaxPostsPerHour.
+const PostCapWindow = time.Hour
+
+// PostCapSpread is the longest extra delay of a send deferred by the cap. It's
+// shorter for higher scores, so the best of the deferred stories is retried
+// first and takes the slot freed.
+const PostCapSpread = 5 * time.Minute
+
+// PostCapError is returned by SendMessage when the chat already has
+// MaxPostsPerHour stories posted in the last PostCapWindow. The send should be
+// retried after RetryAfter.
+type PostCapError struct {
+	ChatID     string
+	RetryAfter time.Duration
+}
+
+func (e *PostCapError) Error() string {
+	return fmt.Sprintf("%s reached its posts per hour, retry after %v", e.ChatID, e.RetryAfter)
+}
+
+// checkPostCap returns a PostCapError if the chat of s can't have another post
+// before one of its last posts leaves the window. Concurrent sends may exceed
+// the cap by the sends in flight.
+func (s *Story) checkPostCap(ctx context.Context, cfg *Config, now time.Time) error {
+	if cfg.MaxPostsPerHour <= 0 {
+		return nil
+	}
+	// Only PostedAt is filtered on by the query so it needs no composite
+	// index.
+	var stories []Story
+	since := now.Add(-PostCapWindow)
+	if _, err := datastore.NewQuery("Story").Filter("PostedAt >=", since).GetAll(ctx, &stories); err != nil {
+		return errors.WithStack(err)
+	}
+	var posted []time.Time
+	for _, story := range stories {
+		if story.ChatID == s.ChatID && story.MessageID != 0 {
+			posted = append(posted, story.PostedAt)
+		}
+	}
+	if int64(len(posted)) < cfg.MaxPostsPerHour {
+		return nil
+	}
+
+	oldest := posted[0]
+	for _, t := range posted[1:] {
+		if t.Before(oldest) {
+			oldest = t
+		}
+	}
+	return &PostCapError{
+		ChatID:     s.ChatID,
+		RetryAfter: oldest.Add(PostCapWindow).Sub(now) + postCapDelay(s.Score),
+	}
+}
+
+// postCapDelay returns the extra delay of a deferred send of a story of the
+// given score, up to PostCapSpread, shorter for higher scores.
+func postCapDelay(score int64) time.Duration {
+	if score < 0 {
+		score = 0
+	}
+	return PostCapSpread * 100 / time.Duration(100+score)
+}
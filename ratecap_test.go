@@ -0,0 +1,71 @@
+package bots
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCheckPostCap(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	// Datastore keeps microseconds.
+	now := time.Now().Truncate(time.Microsecond)
+	for i, s := range []Story{
+		{ID: 1, PostedAt: now.Add(-10 * time.Minute), MessageID: 41},
+		{ID: 2, PostedAt: now.Add(-50 * time.Minute), MessageID: 42},
+		// Past the window.
+		{ID: 3, PostedAt: now.Add(-70 * time.Minute), MessageID: 43},
+		// Claimed, not posted.
+		{ID: 4, PostedAt: now.Add(-5 * time.Minute)},
+	} {
+		for _, chatID := range []string{"@chat", "@other" + strconv.Itoa(i)} {
+			s := s
+			s.ChatID = chatID
+			putStory(ctx, t, GetKey(ctx, SourceHN, chatID, s.ID), &s, now)
+		}
+	}
+	for _, c := range []struct {
+		name     string
+		maxPosts int64
+		score    int64
+		// want is the expected RetryAfter, zero if the post is allowed.
+		want time.Duration
+	}{
+		{"no cap", 0, 0, 0},
+		{"below", 3, 0, 0},
+		{"reached", 2, 0, 10*time.Minute + PostCapSpread},
+		{"reached by a higher score", 2, 100, 10*time.Minute + PostCapSpread/2},
+		{"over", 1, 0, 10*time.Minute + PostCapSpread},
+	} {
+		s := &Story{ID: 10, ChatID: "@chat", Score: c.score}
+		err := s.checkPostCap(ctx, &Config{ChatID: "@chat", MaxPostsPerHour: c.maxPosts}, now)
+		var got time.Duration
+		if err != nil {
+			e, ok := err.(*PostCapError)
+			if !ok {
+				t.Fatalf("%s: checkPostCap() = %v", c.name, err)
+			}
+			got = e.RetryAfter
+		}
+		if got != c.want {
+			t.Errorf("%s: checkPostCap() retries after %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestPostCapDelay(t *testing.T) {
+	for _, c := range []struct {
+		score int64
+		want  time.Duration
+	}{
+		{-10, PostCapSpread},
+		{0, PostCapSpread},
+		{100, PostCapSpread / 2},
+		{300, PostCapSpread / 4},
+	} {
+		if got := postCapDelay(c.score); got != c.want {
+			t.Errorf("postCapDelay(%d) = %v, want %v", c.score, got, c.want)
+		}
+	}
+}
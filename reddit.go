@@ -0,0 +1,178 @@
+package bots
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/appengine/log"
+)
+
+// RedditRetries is the number of retries of a Reddit request answered with 429.
+const RedditRetries = 2
+
+// RedditRetryBackoff is the delay before the first retry of a rate limited
+// Reddit request without Retry-After. It's doubled for each following retry.
+const RedditRetryBackoff = 2 * time.Second
+
+// RedditTopURL is a helper function to get the API of the first limit top posts
+// of the day of a subreddit. raw_json keeps Reddit from escaping the HTML
+// entities of the texts.
+func RedditTopURL(subreddit string, limit int) string {
+	return fmt.Sprintf(`https://www.reddit.com/r/%s/top.json?t=day&limit=%d&raw_json=1`, subreddit, limit)
+}
+
+// RedditItemURL is a helper function to get the API of a Reddit post.
+func RedditItemURL(id int64) string {
+	return `https://www.reddit.com/by_id/` + redditFullname(id) + `.json?raw_json=1`
+}
+
+// redditFullname returns the fullname of the post of the given ID, e.g. t3_abc12.
+// Reddit identifies posts with base 36 IDs, they are converted to int64 IDs.
+func redditFullname(id int64) string {
+	return "t3_" + strconv.FormatInt(id, 36)
+}
+
+// redditListing is a list of posts as returned by the Reddit API.
+type redditListing struct {
+	Data struct {
+		Children []struct {
+			Data redditPost `json:"data"`
+		} `json:"children"`
+	} `json:"data"`
+}
+
+// redditPost is a post as returned by the Reddit API.
+type redditPost struct {
+	Name         string  `json:"name"`
+	Title        string  `json:"title"`
+	URL          string  `json:"url"`
+	Score        int64   `json:"score"`
+	NumComments  int64   `json:"num_comments"`
+	Permalink    string  `json:"permalink"`
+	IsSelf       bool    `json:"is_self"`
+	SelfTextHTML string  `json:"selftext_html"`
+	Author       string  `json:"author"`
+	CreatedUTC   float64 `json:"created_utc"`
+	Stickied     bool    `json:"stickied"`
+	// RemovedByCategory is set once the post is removed, e.g. by the
+	// moderators.
+	RemovedByCategory *string `json:"removed_by_category"`
+}
+
+// id returns the ID of the post, its fullname without prefix in base 36.
+func (p *redditPost) id() (int64, error) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(p.Name, "t3_"), 36, 64)
+	return id, errors.WithStack(err)
+}
+
+// redditSource is the top posts of the day of a subreddit. The IDs of the
+// posts are unique across subreddits.
+type redditSource struct {
+	subreddit string
+}
+
+func (redditSource) Name() string {
+	return SourceReddit
+}
+
+// Feed returns the subreddit, so each subreddit is fetched once per poll.
+func (src redditSource) Feed() Feed {
+	return Feed(src.subreddit)
+}
+
+func (src redditSource) TopItems(ctx context.Context, limit int) ([]int64, error) {
+	var listing redditListing
+	if err := redditGet(ctx, RedditTopURL(src.subreddit, limit), &listing); err != nil {
+		return nil, err
+	}
+
+	var ret []int64
+	for _, child := range listing.Data.Children {
+		// Announcements of the moderators stay pinned on top.
+		if child.Data.Stickied {
+			continue
+		}
+		id, err := child.Data.id()
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, id)
+		if len(ret) == limit {
+			break
+		}
+	}
+	return ret, nil
+}
+
+func (redditSource) Item(ctx context.Context, id int64) (*Item, error) {
+	var listing redditListing
+	if err := redditGet(ctx, RedditItemURL(id), &listing); err != nil {
+		return nil, err
+	}
+	if len(listing.Data.Children) == 0 {
+		log.Infof(ctx, "post %s not found", redditFullname(id))
+		return nil, errors.WithStack(ErrItemDeleted)
+	}
+
+	post := listing.Data.Children[0].Data
+	item := &Item{
+		ID:          id,
+		Type:        "story",
+		Title:       post.Title,
+		URL:         post.URL,
+		Score:       &post.Score,
+		Descendants: &post.NumComments,
+		Deleted:     post.RemovedByCategory != nil,
+		By:          post.Author,
+		Time:        int64(post.CreatedUTC),
+		CommentsURL: "https://www.reddit.com" + post.Permalink,
+	}
+	// The link of self-posts is their comments page.
+	if post.IsSelf {
+		item.URL = ""
+		item.Text = post.SelfTextHTML
+	}
+	return item, nil
+}
+
+// redditGet decodes into v the response of the Reddit API at url. Requests
+// answered with 429 are retried RedditRetries times, after the Retry-After of
+// the response or else with exponential backoff.
+func redditGet(ctx context.Context, url string, v interface{}) error {
+	backoff := RedditRetryBackoff
+	for attempt := 0; ; attempt++ {
+		resp, err := httpGet(ctx, url)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if resp.StatusCode == http.StatusTooManyRequests && attempt < RedditRetries {
+			resp.Body.Close()
+			d := backoff
+			if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s > 0 {
+				d = time.Duration(s) * time.Second
+			}
+			log.Warningf(ctx, "%s rate limited, retrying in %v", url, d)
+			select {
+			case <-time.After(d):
+			case <-ctx.Done():
+				return errors.WithStack(ctx.Err())
+			}
+			backoff *= 2
+			continue
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return errors.Errorf("in redditGet() fetching %s: %s", url, resp.Status)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			return errors.Wrapf(err, "in redditGet() decoding %s", url)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,149 @@
+package bots
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// ReprocessWindow is the duration the deletes scheduled by /reprocess are
+// spread over.
+const ReprocessWindow = 10 * time.Minute
+
+// ReprocessBatchSize is the number of stories read by each query of
+// /reprocess.
+const ReprocessBatchSize = 200
+
+// ReprocessMaxBatches bounds the batches of stories handled by one request or
+// task. The remaining stories are handled by a continuation task.
+const ReprocessMaxBatches = 10
+
+// reprocessHandler checks the saved stories against the current configs of
+// their chats, and schedules the deletes of the ones no longer passing them.
+// The stories aren't fetched again, their saved scores are used. Running it
+// again only schedules the deletes of the stories not deleted yet. The
+// response counts the deletes scheduled before the continuation task, if any.
+func reprocessHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	ctx := appengine.NewContext(r)
+
+	scheduled, continued, err := reprocessStories(ctx, "")
+	if err != nil {
+		loge(ctx, err)
+		http.Error(w, "datastore error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"scheduled": scheduled, "continued": continued})
+}
+
+// reprocess is called by reprocessFunc to continue a reprocess from the cursor
+// where it stopped.
+func reprocess(ctx context.Context, cursor string) {
+	scheduled, _, err := reprocessStories(ctx, cursor)
+	if err != nil {
+		loge(ctx, err)
+	}
+	log.Infof(ctx, "reprocess scheduled %d deletes", scheduled)
+}
+
+// reprocessStories schedules the deletes of the stories no longer passing the
+// configs of their chats, from cursor on or from the first story when it's
+// empty. It returns the number of scheduled deletes, and whether the remaining
+// stories were left to reprocessFunc.
+func reprocessStories(ctx context.Context, cursor string) (int64, bool, error) {
+	configs, err := LoadConfigs(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+	configsByChat := make(map[string]*Config)
+	for _, cfg := range configs {
+		configsByChat[cfg.ChatID] = cfg
+	}
+
+	var scheduled int64
+	for batch := 0; batch < ReprocessMaxBatches; batch++ {
+		q := datastore.NewQuery("Story").Limit(ReprocessBatchSize)
+		if cursor != "" {
+			start, err := datastore.DecodeCursor(cursor)
+			if err != nil {
+				return scheduled, false, errors.WithStack(err)
+			}
+			q = q.Start(start)
+		}
+
+		var tasks []func()
+		n := 0
+		it := q.Run(ctx)
+		for {
+			var story Story
+			_, err := it.Next(&story)
+			if err == datastore.Done {
+				break
+			}
+			if err != nil {
+				return scheduled, false, errors.WithStack(err)
+			}
+			n++
+			if task := reprocessTask(ctx, configsByChat, story, &scheduled); task != nil {
+				tasks = append(tasks, task)
+			}
+		}
+		if skipped := runBounded(ctx, MaxConcurrency, tasks); skipped > 0 {
+			// The continuation goes over the batch again, the deletes
+			// already scheduled are harmless.
+			return scheduled, true, continueReprocess(ctx, cursor)
+		}
+
+		if n < ReprocessBatchSize {
+			return scheduled, false, nil
+		}
+		next, err := it.Cursor()
+		if err != nil {
+			return scheduled, false, errors.WithStack(err)
+		}
+		cursor = next.String()
+	}
+	log.Infof(ctx, "reprocess continues after %d batches", ReprocessMaxBatches)
+	return scheduled, true, continueReprocess(ctx, cursor)
+}
+
+// continueReprocess schedules the reprocess of the stories from cursor on.
+func continueReprocess(ctx context.Context, cursor string) error {
+	return errors.WithStack(callFunc(ctx, reprocessFunc, cursor))
+}
+
+// reprocessTask returns the task scheduling the delete of story if it no longer
+// passes the config of its chat, or nil. The scheduled deletes are counted in
+// scheduled.
+func reprocessTask(ctx context.Context, configsByChat map[string]*Config, story Story, scheduled *int64) func() {
+	// Stories being sent have no message yet.
+	if story.MessageID == 0 {
+		return nil
+	}
+	cfg, ok := configsByChat[story.ChatID]
+	if !ok {
+		cfg = DefaultConfig(story.ChatID)
+	}
+	if !story.ShouldIgnore(cfg) && !(story.URL != "" && cfg.IsBlacklisted(hostFromURL(story.URL))) {
+		return nil
+	}
+	id, messageID, chatID, source := story.ID, story.MessageID, story.ChatID, story.Source
+	return func() {
+		if err := callLater(ctx, deleteMessageFunc, spreadDelay(id, ReprocessWindow), id, messageID, chatID, source); err != nil {
+			loge(ctx, err)
+			return
+		}
+		atomic.AddInt64(scheduled, 1)
+	}
+}
@@ -0,0 +1,56 @@
+package bots
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/delay"
+)
+
+func TestReprocessStories(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	var cursors []string
+	defer func(orig func(context.Context, *delay.Function, ...interface{}) error) { callFunc = orig }(callFunc)
+	callFunc = func(ctx context.Context, f *delay.Function, args ...interface{}) error {
+		if f != reprocessFunc {
+			t.Errorf("unexpected call of %v", f)
+		}
+		cursors = append(cursors, args[0].(string))
+		return nil
+	}
+
+	// One story more than a reprocess goes over, every other one below the
+	// MinScore of the chat.
+	n := ReprocessMaxBatches*ReprocessBatchSize + 1
+	var keys []*datastore.Key
+	var stories []*Story
+	for id := int64(1); id <= int64(n); id++ {
+		score := int64(1000)
+		if id%2 == 1 {
+			score = 0
+		}
+		keys = append(keys, GetKey(ctx, SourceHN, DefaultChatID, id))
+		stories = append(stories, &Story{ID: id, Type: "story", Title: "A story", Score: score, Descendants: 100, ChatID: DefaultChatID, MessageID: id})
+	}
+	if _, err := datastore.PutMulti(ctx, keys, stories); err != nil {
+		t.Fatal(err)
+	}
+
+	scheduled, continued, err := reprocessStories(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(n / 2); scheduled != want || !continued || len(cursors) != 1 {
+		t.Fatalf("reprocessStories() = %d, %v with %d continuations, want %d, true with one", scheduled, continued, len(cursors), want)
+	}
+	// The continuation goes over the last story.
+	scheduled, continued, err = reprocessStories(ctx, cursors[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scheduled != 1 || continued || len(cursors) != 1 {
+		t.Errorf("continued reprocessStories() = %d, %v with %d continuations, want 1, false with none", scheduled, continued, len(cursors)-1)
+	}
+}
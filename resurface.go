@@ -0,0 +1,99 @@
+package bots
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+)
+
+// PolledStoriesTTL is how long the stories seen by the last poll of a chat are
+// remembered, so a poll after a longer break detects no drop.
+const PolledStoriesTTL = time.Hour
+
+// polledStoriesKey is the memcache key of the stories seen by the last poll of
+// the given chat.
+func polledStoriesKey(chatID string) string {
+	return "PolledStories/" + chatID
+}
+
+// droppedStories returns the keys of the stories seen by the last poll of the
+// chat but no longer in keys, the ones seen by this poll, and records keys for
+// the next poll. Memcache errors only lose the drops of a poll.
+func droppedStories(ctx context.Context, chatID string, keys []*datastore.Key) []*datastore.Key {
+	var prev []string
+	if _, err := memcache.JSON.Get(ctx, polledStoriesKey(chatID), &prev); err != nil && err != memcache.ErrCacheMiss {
+		log.Warningf(ctx, "getting the polled stories of %s: %v", chatID, err)
+	}
+	cur := make([]string, len(keys))
+	seen := make(StringSet)
+	for i, key := range keys {
+		cur[i] = key.Encode()
+		seen.Add(cur[i])
+	}
+	item := &memcache.Item{Key: polledStoriesKey(chatID), Object: cur, Expiration: PolledStoriesTTL}
+	if err := memcache.JSON.Set(ctx, item); err != nil {
+		log.Warningf(ctx, "setting the polled stories of %s: %v", chatID, err)
+	}
+
+	var dropped []*datastore.Key
+	for _, s := range prev {
+		if seen.Contains(s) {
+			continue
+		}
+		key, err := datastore.DecodeKey(s)
+		if err != nil {
+			log.Warningf(ctx, "decoding polled story %q: %v", s, err)
+			continue
+		}
+		dropped = append(dropped, key)
+	}
+	return dropped
+}
+
+// markDropped records in the story of key that it left the feeds of its chat
+// at now, unless it already did or has no message.
+func markDropped(ctx context.Context, key *datastore.Key, now time.Time) error {
+	return setDroppedAt(ctx, key, func(story *Story) bool {
+		if story.MessageID == 0 || !story.DroppedAt.IsZero() {
+			return false
+		}
+		story.DroppedAt = now
+		return true
+	})
+}
+
+// markReturned records in the story of key that it's back in the feeds of its
+// chat within Config.ResurfaceAfter, so its message stays.
+func markReturned(ctx context.Context, key *datastore.Key) error {
+	return setDroppedAt(ctx, key, func(story *Story) bool {
+		if story.DroppedAt.IsZero() {
+			return false
+		}
+		story.DroppedAt = time.Time{}
+		return true
+	})
+}
+
+// setDroppedAt saves the story of key in a transaction if update changed it.
+// Saving also refreshes LastSave. Stories deleted meanwhile are left alone.
+func setDroppedAt(ctx context.Context, key *datastore.Key, update func(*Story) bool) error {
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		var story Story
+		err := datastore.Get(ctx, key, &story)
+		if err == datastore.ErrNoSuchEntity {
+			return nil
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if !update(&story) {
+			return nil
+		}
+		_, err = datastore.Put(ctx, key, &story)
+		return errors.WithStack(err)
+	}, nil)
+}
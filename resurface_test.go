@@ -0,0 +1,101 @@
+package bots
+
+import (
+	"io"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+)
+
+func TestDroppedStories(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	keys := func(ids ...int64) []*datastore.Key {
+		var ret []*datastore.Key
+		for _, id := range ids {
+			ret = append(ret, GetKey(ctx, SourceHN, "@chat", id))
+		}
+		return ret
+	}
+	for _, c := range []struct {
+		polled []int64
+		want   []int64
+	}{
+		// No poll before.
+		{[]int64{1, 2, 3}, nil},
+		{[]int64{1, 2, 3}, nil},
+		{[]int64{1, 3, 4}, []int64{2}},
+		{[]int64{2}, []int64{1, 3, 4}},
+		{nil, []int64{2}},
+		{[]int64{1}, nil},
+	} {
+		got := droppedStories(ctx, "@chat", keys(c.polled...))
+		var ids []int64
+		for _, key := range got {
+			ids = append(ids, key.IntID())
+		}
+		if !reflect.DeepEqual(ids, c.want) {
+			t.Errorf("droppedStories(%v) = %v, want %v", c.polled, ids, c.want)
+		}
+	}
+	// Chats have their own polls.
+	if got := droppedStories(ctx, "@other", nil); len(got) != 0 {
+		t.Errorf("droppedStories() of another chat = %v", got)
+	}
+}
+
+func TestPollChatResurface(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	server := newFakeServer(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "[1,2,3]")
+	})
+	defer server.Close()
+
+	cfg := DefaultConfig(DefaultChatID)
+	cfg.ResurfaceAfterHours = 6
+	now := time.Now()
+	for _, s := range []Story{
+		// Back within the window.
+		{ID: 1, MessageID: 41, DroppedAt: now.Add(-time.Hour)},
+		// Back after the window, posted again.
+		{ID: 2, MessageID: 42, DroppedAt: now.Add(-7 * time.Hour)},
+		{ID: 3, MessageID: 43},
+		// Dropped by this poll.
+		{ID: 4, MessageID: 44},
+	} {
+		s := s
+		s.ChatID = DefaultChatID
+		putStory(ctx, t, GetKey(ctx, SourceHN, DefaultChatID, s.ID), &s, now)
+	}
+	// The last poll saw story 4.
+	droppedStories(ctx, DefaultChatID, []*datastore.Key{GetKey(ctx, SourceHN, DefaultChatID, 4)})
+
+	var summary PollSummary
+	tasks := pollChat(ctx, cfg, make(map[string][]int64), BatchSize, &summary)
+	runBounded(ctx, MaxConcurrency, tasks)
+	// Stories 1 and 3 are edited by the next poll and this one.
+	if summary.Edits != 1 || summary.Errors != 0 {
+		t.Errorf("pollChat() summary = %+v, want 1 edit", summary)
+	}
+	for _, c := range []struct {
+		id      int64
+		dropped bool
+	}{
+		{1, false},
+		{2, true},
+		{3, false},
+		{4, true},
+	} {
+		story, err := NewFromDatastore(ctx, SourceHN, DefaultChatID, c.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dropped := !story.DroppedAt.IsZero(); dropped != c.dropped {
+			t.Errorf("story %d dropped %v, want %v", c.id, dropped, c.dropped)
+		}
+	}
+}
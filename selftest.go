@@ -0,0 +1,92 @@
+package bots
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/appengine"
+)
+
+// SelfTest is the response of the /admin/selftest endpoint.
+type SelfTest struct {
+	OK     bool   `json:"ok"`
+	ChatID string `json:"chat_id"`
+	// Steps is the steps run, in order. The message is neither edited nor
+	// deleted when it couldn't be sent.
+	Steps []SelfTestStep `json:"steps"`
+}
+
+// SelfTestStep is the outcome of a Telegram call of SelfTest.
+type SelfTestStep struct {
+	Method string `json:"method"`
+	OK     bool   `json:"ok"`
+	Error  string `json:"error,omitempty"`
+}
+
+// selfTestHandler posts a sample story to the chat of SELFTEST_CHAT_ID, edits
+// it, then deletes it, and reports each step as a SelfTest. The messages are
+// built like the ones of the live chats, but nothing is saved, so it's safe to
+// run after a deploy or a rotation of the bot tokens. The bot parameter tests
+// the bot of the given ID rather than the default bot.
+func selfTestHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	ctx := appengine.NewContext(r)
+
+	chatID := os.Getenv("SELFTEST_CHAT_ID")
+	if chatID == "" {
+		http.Error(w, "SELFTEST_CHAT_ID is not set", http.StatusNotFound)
+		return
+	}
+	if s := r.FormValue("bot"); s != "" {
+		botID, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid bot id", http.StatusBadRequest)
+			return
+		}
+		ctx = withBot(ctx, botID)
+	}
+
+	story := Story{
+		ID:     1,
+		ChatID: chatID,
+		Source: SourceHN,
+		Type:   KindStory,
+		Title:  "Self-test " + time.Now().UTC().Format(time.RFC3339),
+		URL:    "https://news.ycombinator.com/",
+		Score:  1,
+	}
+	test := SelfTest{OK: true, ChatID: chatID}
+	step := func(method string, err error) bool {
+		result := SelfTestStep{Method: method, OK: err == nil}
+		if err != nil {
+			loge(ctx, err)
+			result.Error = err.Error()
+			test.OK = false
+		}
+		test.Steps = append(test.Steps, result)
+		return err == nil
+	}
+
+	var err error
+	story.MessageID, err = postMessage(ctx, story.ToSendMessageRequest())
+	if step("sendMessage", err) {
+		story.Score, story.Descendants = 2, 1
+		step("editMessageText", callTelegram(ctx, "editMessageText", story.ToEditMessageTextRequest(), nil))
+		// Clean up the test chat even if the edit failed.
+		step("deleteMessage", callTelegram(ctx, "deleteMessage", story.ToDeleteMessageRequest(), nil))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !test.OK {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	if err := json.NewEncoder(w).Encode(test); err != nil {
+		loge(ctx, errors.WithStack(err))
+	}
+}
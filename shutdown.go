@@ -0,0 +1,84 @@
+package bots
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+)
+
+// CronDeadline is how long App Engine lets a cron request run before it kills
+// it.
+const CronDeadline = 10 * time.Minute
+
+// StopMargin is how long before the deadline of their context the handlers stop
+// scheduling new tasks, so the started ones have time to finish.
+const StopMargin = 10 * time.Second
+
+// AppEngineAdminHeader is set to "1" by App Engine on its own requests and the
+// ones of the admins of the app, and stripped from the other requests.
+const AppEngineAdminHeader = "X-Appengine-User-Is-Admin"
+
+// errDraining is returned by schedulingStopped once the instance is shutting
+// down.
+var errDraining = errors.New("instance draining")
+
+// errDeadlineNear is returned by schedulingStopped once the deadline of the
+// request is within StopMargin.
+var errDeadlineNear = errors.New("request deadline near")
+
+// withCronDeadline returns ctx with the deadline App Engine gives the cron
+// requests, so schedulingStopped stops their handler before it's killed.
+func withCronDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, CronDeadline)
+}
+
+// drain is closed by startDraining.
+var (
+	drain     = make(chan struct{})
+	drainOnce sync.Once
+)
+
+// startDraining makes the handlers stop scheduling new tasks, while the running
+// ones finish.
+func startDraining(ctx context.Context) {
+	drainOnce.Do(func() {
+		log.Infof(ctx, "draining, no new task is scheduled")
+		close(drain)
+	})
+}
+
+// stopHandler handles /_ah/stop, which App Engine only requests before it shuts
+// down an instance of a manual or basic scaling service. Under automatic
+// scaling the handlers stop at the deadline of their request instead, see
+// schedulingStopped. Draining is for good, so only App Engine and the admins
+// may request it.
+func stopHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get(AppEngineAdminHeader) != "1" && !requireAdmin(w, r) {
+		return
+	}
+	startDraining(appengine.NewContext(r))
+}
+
+// schedulingStopped returns why the handlers must stop scheduling new tasks:
+// the error of ctx once it's done, errDeadlineNear once its deadline is within
+// StopMargin, errDraining once /_ah/stop was requested, or nil. Tasks already
+// started are left to finish.
+func schedulingStopped(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < StopMargin {
+		return errDeadlineNear
+	}
+	select {
+	case <-drain:
+		return errDraining
+	default:
+		return nil
+	}
+}
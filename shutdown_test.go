@@ -0,0 +1,67 @@
+package bots
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStopHandler(t *testing.T) {
+	defer os.Setenv("ADMIN_TOKEN", os.Getenv("ADMIN_TOKEN"))
+	os.Setenv("ADMIN_TOKEN", "secret")
+	defer func() {
+		drain, drainOnce = make(chan struct{}), sync.Once{}
+	}()
+	for _, c := range []struct {
+		name   string
+		header string
+		value  string
+		want   bool
+	}{
+		{"anyone", "", "", false},
+		{"not admin", AppEngineAdminHeader, "0", false},
+		{"wrong token", AdminTokenHeader, "wrong", false},
+		{"App Engine", AppEngineAdminHeader, "1", true},
+		{"admin token", AdminTokenHeader, "secret", true},
+	} {
+		drain, drainOnce = make(chan struct{}), sync.Once{}
+		req, done := newTestRequest(t, http.MethodGet, "/_ah/stop", nil)
+		if c.header != "" {
+			req.Header.Set(c.header, c.value)
+		}
+		w := httptest.NewRecorder()
+		stopHandler(w, req)
+		done()
+		got := schedulingStopped(context.Background()) == errDraining
+		if got != c.want {
+			t.Errorf("%s: stopHandler() drained %v, want %v", c.name, got, c.want)
+		}
+		if !c.want && w.Code != http.StatusForbidden {
+			t.Errorf("%s: stopHandler() status %d, want %d", c.name, w.Code, http.StatusForbidden)
+		}
+	}
+}
+
+func TestSchedulingStoppedDeadline(t *testing.T) {
+	for _, c := range []struct {
+		left time.Duration
+		want error
+	}{
+		{CronDeadline, nil},
+		{2 * StopMargin, nil},
+		{StopMargin / 2, errDeadlineNear},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), c.left)
+		if err := schedulingStopped(ctx); err != c.want {
+			t.Errorf("schedulingStopped() %v before the deadline = %v, want %v", c.left, err, c.want)
+		}
+		cancel()
+	}
+	if err := schedulingStopped(context.Background()); err != nil {
+		t.Errorf("schedulingStopped() without a deadline = %v, want nil", err)
+	}
+}
@@ -0,0 +1,116 @@
+package bots
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"google.golang.org/appengine/log"
+)
+
+// Names of the sources stories are fetched from.
+const (
+	SourceHN       = "hn"
+	SourceLobsters = "lobsters"
+	SourceReddit   = "reddit"
+)
+
+// Item is a story as fetched from a Source.
+type Item struct {
+	ID    int64  `json:"id"`
+	Type  string `json:"type"`
+	Title string `json:"title"`
+	URL   string `json:"url"`
+	// Score and Descendants are nil when the item has none, e.g. jobs, or
+	// stories not scored yet.
+	Score       *int64 `json:"score"`
+	Descendants *int64 `json:"descendants"`
+	Deleted     bool   `json:"deleted"`
+	Dead        bool   `json:"dead"`
+	By          string `json:"by"`
+	// Time is the submission time in Unix seconds, zero when unknown.
+	Time int64 `json:"time"`
+	// Text is the HTML text of self-posts like Ask HN.
+	Text        string `json:"text"`
+	CommentsURL string `json:"-"`
+}
+
+// Source is a site stories are fetched from.
+type Source interface {
+	// Name is the name of the source, it disambiguates the IDs of the stories
+	// of different sources.
+	Name() string
+	// Feed is the story list of the source returned by TopItems.
+	Feed() Feed
+	// TopItems returns the IDs of the first limit stories in the feed, in
+	// order.
+	TopItems(ctx context.Context, limit int) ([]int64, error)
+	// Item fetches the story of the given ID.
+	Item(ctx context.Context, id int64) (*Item, error)
+}
+
+// NewSource returns the source of the given name polling the given feed. An
+// empty name is Hacker News, the only source before others were supported.
+func NewSource(name string, feed Feed) (Source, error) {
+	switch name {
+	case SourceHN, "":
+		return hnSource{feed: feed}, nil
+	case SourceLobsters:
+		return lobstersSource{}, nil
+	case SourceReddit:
+		return redditSource{subreddit: string(feed)}, nil
+	}
+	return nil, fmt.Errorf("unknown source %q", name)
+}
+
+// fetchItem fetches the item of the given ID from the source of the given name,
+// polling the given feed. It's the single place items are fetched.
+func fetchItem(ctx context.Context, source string, feed Feed, id int64) (*Item, error) {
+	src, err := NewSource(source, feed)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	item, err := src.Item(ctx, id)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return item, nil
+}
+
+// hnSource is a Hacker News feed.
+type hnSource struct {
+	feed Feed
+}
+
+func (hnSource) Name() string {
+	return SourceHN
+}
+
+func (src hnSource) Feed() Feed {
+	return src.feed
+}
+
+func (src hnSource) TopItems(ctx context.Context, limit int) ([]int64, error) {
+	return getTopStoriesCached(ctx, src.feed, limit, topStoriesTTL(ctx))
+}
+
+func (hnSource) Item(ctx context.Context, id int64) (*Item, error) {
+	resp, err := httpGet(ctx, ItemURL(id))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	// Purged items are returned as null.
+	var item *Item
+	if err := json.NewDecoder(resp.Body).Decode(&item); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if item == nil || item.ID == 0 {
+		log.Infof(ctx, "item %d not found", id)
+		return nil, errors.WithStack(ErrItemDeleted)
+	}
+	item.CommentsURL = NewsURL(id)
+	return item, nil
+}
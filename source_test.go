@@ -0,0 +1,86 @@
+package bots
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestHNItemNull(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	for _, c := range []struct {
+		name, body string
+		want       error
+	}{
+		{"item", `{"id":1,"type":"story","title":"A story","score":100}`, nil},
+		{"null", `null`, ErrItemDeleted},
+		{"null with spaces", " null\n", ErrItemDeleted},
+		{"zero ID", `{"id":0,"type":"story"}`, ErrItemDeleted},
+		{"empty object", `{}`, ErrItemDeleted},
+	} {
+		server := newFakeServer(func(w http.ResponseWriter, r *http.Request) {
+			if r.Host == "hacker-news.firebaseio.com" {
+				io.WriteString(w, c.body)
+				return
+			}
+			io.WriteString(w, `{"ok":true,"result":{"message_id":42}}`)
+		})
+		item, err := hnSource{}.Item(ctx, 1)
+		if errors.Cause(err) != c.want {
+			t.Errorf("%s: Item() = %+v, %v, want %v", c.name, item, err, c.want)
+		}
+		// Its story is skipped without posting anything.
+		s := &Story{ID: 1, ChatID: "@chat", Source: SourceHN}
+		err = s.SendMessage(ctx, &Config{})
+		server.Close()
+		if c.want != nil && (!isIgnored(err) || len(server.TelegramRequests()) != 0) {
+			t.Errorf("%s: SendMessage() = %v with %d Telegram requests, want it ignored", c.name, err, len(server.TelegramRequests()))
+		}
+	}
+}
+
+func TestFillFromItemMissingCounts(t *testing.T) {
+	cfg := &Config{MinScore: 50, MinComments: 5}
+	for _, c := range []struct {
+		name, item string
+		// The saved story has a score of 80 and 8 comments.
+		score, comments int64
+		reason          string
+	}{
+		{"both", `{"id":1,"type":"story","score":100,"descendants":10}`, 100, 10, ""},
+		{"zeros", `{"id":1,"type":"story","score":0,"descendants":0}`, 0, 0, IgnoreScore},
+		{"zero comments", `{"id":1,"type":"story","score":100,"descendants":0}`, 100, 0, IgnoreComments},
+		// A missing score keeps the saved one.
+		{"no score", `{"id":1,"type":"story","descendants":10}`, 80, 10, ""},
+		// Missing comments skip the comments threshold.
+		{"no comments", `{"id":1,"type":"story","score":100}`, 100, 8, ""},
+		{"null comments", `{"id":1,"type":"story","score":100,"descendants":null}`, 100, 8, ""},
+		{"neither", `{"id":1,"type":"story"}`, 80, 8, ""},
+	} {
+		var item Item
+		if err := json.Unmarshal([]byte(c.item), &item); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		s := &Story{ID: 1, Score: 80, Descendants: 8}
+		s.FillFromItem(&item)
+		if s.Score != c.score || s.Descendants != c.comments {
+			t.Errorf("%s: FillFromItem() = %d points and %d comments, want %d and %d", c.name, s.Score, s.Descendants, c.score, c.comments)
+		}
+		if got := s.IgnoreReason(cfg); got != c.reason {
+			t.Errorf("%s: IgnoreReason() = %q, want %q", c.name, got, c.reason)
+		}
+	}
+
+	// A new story not scored yet is ignored until it is.
+	var item Item
+	json.Unmarshal([]byte(`{"id":2,"type":"story"}`), &item)
+	s := &Story{ID: 2}
+	s.FillFromItem(&item)
+	if got := s.IgnoreReason(cfg); got != IgnoreScore {
+		t.Errorf("IgnoreReason() of a new story without score = %q, want %q", got, IgnoreScore)
+	}
+}
@@ -0,0 +1,101 @@
+package bots
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// Stats is the response of the /stats endpoint.
+type Stats struct {
+	TrackedStories int               `json:"tracked_stories"`
+	PostedLastDay  int               `json:"posted_last_day"`
+	TopStory       *StatsStory       `json:"top_story,omitempty"`
+	Thresholds     []StatsThresholds `json:"thresholds"`
+	// TelegramCalls is the number of Telegram API calls by day and outcome,
+	// see TelegramCallCounts.
+	TelegramCalls map[string]map[string]uint64 `json:"telegram_calls,omitempty"`
+}
+
+// StatsStory is a story in Stats.
+type StatsStory struct {
+	ID          int64  `json:"id"`
+	ChatID      string `json:"chat_id"`
+	Title       string `json:"title"`
+	Score       int64  `json:"score"`
+	Descendants int64  `json:"descendants"`
+	PostedAgo   string `json:"posted_ago,omitempty"`
+}
+
+// StatsThresholds is the thresholds of a chat in Stats.
+type StatsThresholds struct {
+	ChatID      string `json:"chat_id"`
+	MinScore    int64  `json:"min_score"`
+	MinComments int64  `json:"min_comments"`
+}
+
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	var stats Stats
+	var err error
+
+	stats.TrackedStories, err = datastore.NewQuery("Story").KeysOnly().Count(ctx)
+	if err != nil {
+		loge(ctx, errors.WithStack(err))
+		http.Error(w, "datastore error", http.StatusInternalServerError)
+		return
+	}
+
+	stats.PostedLastDay, err = datastore.NewQuery("Story").Filter("PostedAt >=", time.Now().Add(-24*time.Hour)).KeysOnly().Count(ctx)
+	if err != nil {
+		loge(ctx, errors.WithStack(err))
+		http.Error(w, "datastore error", http.StatusInternalServerError)
+		return
+	}
+
+	var top []Story
+	if _, err := datastore.NewQuery("Story").Order("-Score").Limit(1).GetAll(ctx, &top); err != nil {
+		loge(ctx, errors.WithStack(err))
+		http.Error(w, "datastore error", http.StatusInternalServerError)
+		return
+	}
+	if len(top) != 0 {
+		stats.TopStory = &StatsStory{
+			ID:          top[0].ID,
+			ChatID:      top[0].ChatID,
+			Title:       top[0].Title,
+			Score:       top[0].Score,
+			Descendants: top[0].Descendants,
+			PostedAgo:   top[0].PostedAgo(time.Now()),
+		}
+	}
+
+	configs, err := LoadConfigs(ctx)
+	if err != nil {
+		loge(ctx, err)
+		http.Error(w, "datastore error", http.StatusInternalServerError)
+		return
+	}
+	for _, cfg := range configs {
+		stats.Thresholds = append(stats.Thresholds, StatsThresholds{
+			ChatID:      cfg.ChatID,
+			MinScore:    cfg.MinScore,
+			MinComments: cfg.MinComments,
+		})
+	}
+
+	// The counters are best effort, the other stats are still shown.
+	if stats.TelegramCalls, err = TelegramCallCounts(ctx, time.Now()); err != nil {
+		loge(ctx, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		loge(ctx, errors.WithStack(err))
+	}
+}
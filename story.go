@@ -1,12 +1,12 @@
 package bots
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
-	"io"
-	"io/ioutil"
+	"hash/fnv"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -14,6 +14,18 @@ import (
 	"google.golang.org/appengine/log"
 )
 
+// ScoreBucket and CommentsBucket are the granularity of the score and the
+// number of comments shown in a message. Smaller changes don't edit the message.
+const (
+	ScoreBucket    = 10
+	CommentsBucket = 10
+)
+
+// KeepAliveInterval is how long a story whose message is unchanged may go
+// without being saved. Saving refreshes LastSave, which keeps the story from
+// being cleaned up while it's still polled.
+const KeepAliveInterval = time.Hour
+
 // Hot is the sign for a hot story, either because it has high score or it has
 // large number of discussions.
 const Hot = "🔥"
@@ -27,15 +39,46 @@ type Story struct {
 	Descendants         int64     `json:"descendants"`
 	Score               int64     `json:"score"`
 	MessageID           int64     `json:"-"`
+	ChatID              string    `json:"-"`
+	ContentHash         string    `json:"-"`
+	MarkupHash          string    `json:"-"`
+	PrevScore           int64     `json:"-"`
+	PrevComments        int64     `json:"-"`
+	ShownScore          int64     `json:"-"`
+	ShownComments       int64     `json:"-"`
 	LastSave            time.Time `json:"-"`
+	PostedAt            time.Time `json:"-"`
 	Type                string    `json:"type"`
+	Deleted             bool      `json:"deleted"`
+	Dead                bool      `json:"dead"`
+	Feed                Feed      `json:"-"`
+	Source              string    `json:"-"`
+	CommentsURL         string    `json:"-"`
+	LastMilestone       int64     `json:"-"`
+	LastReaction        int64     `json:"-"`
+	EditCount           int64     `json:"-"`
+	By                  string    `json:"by"`
+	NormURL             string    `json:"-"`
+	HasPhoto            bool      `json:"-"`
+	LastEditScheduled   time.Time `json:"-"`
+	HNTime              time.Time `json:"-"`
+	SelfText            string    `json:"text"`
+	Rank                int64     `json:"-"`
+	BotID               int64     `json:"-"`
+	Combined            bool      `json:"-"`
+	Suppressed          bool      `json:"-"`
+	PostedChatID        string    `json:"-"`
+	MessageThreadID     int64     `json:"-"`
+	DroppedAt           time.Time `json:"-"`
+	commentsMissing     bool
 	missingFieldsLoaded bool
 }
 
-// NewFromDatastore create a Story from datastore.
-func NewFromDatastore(ctx context.Context, id int64) (Story, error) {
+// NewFromDatastore create a Story of the given source posted in the given chat
+// from datastore.
+func NewFromDatastore(ctx context.Context, source, chatID string, id int64) (Story, error) {
 	var story Story
-	if err := datastore.Get(ctx, GetKey(ctx, id), &story); err != nil {
+	if err := datastore.Get(ctx, GetKey(ctx, source, chatID, id), &story); err != nil {
 		return story, errors.WithStack(err)
 	}
 	return story, nil
@@ -43,7 +86,18 @@ func NewFromDatastore(ctx context.Context, id int64) (Story, error) {
 
 // Load implements the PropertyLoadSaver interface.
 func (s *Story) Load(ps []datastore.Property) error {
-	return datastore.LoadStruct(s, ps)
+	if err := datastore.LoadStruct(s, ps); err != nil {
+		return err
+	}
+	// Stories saved before multiple chats were supported have no chat ID.
+	if s.ChatID == "" {
+		s.ChatID = DefaultChatID
+	}
+	// Nor a source.
+	if s.Source == "" {
+		s.Source = SourceHN
+	}
+	return nil
 }
 
 // Save implements the PropertyLoadSaver interface.
@@ -57,59 +111,397 @@ func (s *Story) Save() ([]datastore.Property, error) {
 			Name:  "ID",
 			Value: s.ID,
 		},
+		{
+			Name:  "ChatID",
+			Value: s.ChatID,
+		},
+		{
+			Name:  "Feed",
+			Value: string(s.Feed),
+		},
+		{
+			Name:  "Source",
+			Value: s.Source,
+		},
+		{
+			Name:    "CommentsURL",
+			Value:   s.CommentsURL,
+			NoIndex: true,
+		},
+		{
+			Name:    "Title",
+			Value:   s.Title,
+			NoIndex: true,
+		},
+		{
+			Name:    "URL",
+			Value:   s.URL,
+			NoIndex: true,
+		},
+		{
+			Name:  "Score",
+			Value: s.Score,
+		},
+		{
+			Name:  "Descendants",
+			Value: s.Descendants,
+		},
+		{
+			Name:  "Type",
+			Value: s.Type,
+		},
+		{
+			Name:  "PrevScore",
+			Value: s.PrevScore,
+		},
+		{
+			Name:  "PrevComments",
+			Value: s.PrevComments,
+		},
+		{
+			Name:  "ShownScore",
+			Value: s.ShownScore,
+		},
+		{
+			Name:  "ShownComments",
+			Value: s.ShownComments,
+		},
+		{
+			Name:    "ContentHash",
+			Value:   s.ContentHash,
+			NoIndex: true,
+		},
+		{
+			Name:    "MarkupHash",
+			Value:   s.MarkupHash,
+			NoIndex: true,
+		},
 		{
 			Name:  "LastSave",
 			Value: time.Now(),
 		},
+		{
+			Name:  "PostedAt",
+			Value: s.PostedAt,
+		},
+		{
+			Name:  "NormURL",
+			Value: normalizeURL(s.URL),
+		},
+		{
+			Name:    "SelfText",
+			Value:   s.SelfText,
+			NoIndex: true,
+		},
+		{
+			Name:    "HNTime",
+			Value:   s.HNTime,
+			NoIndex: true,
+		},
+		{
+			Name:    "Combined",
+			Value:   s.Combined,
+			NoIndex: true,
+		},
+		{
+			Name:    "Suppressed",
+			Value:   s.Suppressed,
+			NoIndex: true,
+		},
+		{
+			Name:    "PostedChatID",
+			Value:   s.PostedChatID,
+			NoIndex: true,
+		},
+		{
+			Name:    "MessageThreadID",
+			Value:   s.MessageThreadID,
+			NoIndex: true,
+		},
+		{
+			Name:    "DroppedAt",
+			Value:   s.DroppedAt,
+			NoIndex: true,
+		},
+		{
+			Name:    "BotID",
+			Value:   s.BotID,
+			NoIndex: true,
+		},
+		{
+			Name:    "Rank",
+			Value:   s.Rank,
+			NoIndex: true,
+		},
+		{
+			Name:    "LastEditScheduled",
+			Value:   s.LastEditScheduled,
+			NoIndex: true,
+		},
+		{
+			Name:    "HasPhoto",
+			Value:   s.HasPhoto,
+			NoIndex: true,
+		},
+		{
+			Name:    "By",
+			Value:   s.By,
+			NoIndex: true,
+		},
+		{
+			Name:    "LastMilestone",
+			Value:   s.LastMilestone,
+			NoIndex: true,
+		},
+		{
+			Name:    "LastReaction",
+			Value:   s.LastReaction,
+			NoIndex: true,
+		},
+		{
+			Name:    "EditCount",
+			Value:   s.EditCount,
+			NoIndex: true,
+		},
 	}, nil
 }
 
-// FillMissingFields is used to fill the missing story data from HN API.
+// FillMissingFields is used to fill the missing story data from its source.
 func (s *Story) FillMissingFields(ctx context.Context) error {
-	resp, err := myHTTPClient(ctx).Get(ItemURL(s.ID))
+	item, err := fetchItem(ctx, s.Source, s.Feed, s.ID)
 	if err != nil {
-		return errors.WithStack(err)
+		return err
 	}
-	defer resp.Body.Close()
+	s.FillFromItem(item)
+	return nil
+}
 
-	err = json.NewDecoder(resp.Body).Decode(s)
-	if err != nil {
-		return errors.WithStack(err)
+// FillFromItem fills the story data from item, as fetched from its source.
+func (s *Story) FillFromItem(item *Item) {
+	s.Type = item.Type
+	s.Title = item.Title
+	s.URL = item.URL
+	// Missing counts keep their saved values, zero for new stories, so a
+	// story not scored yet is ignored until it is. Stories without a number
+	// of comments skip the comments threshold.
+	if item.Score != nil {
+		s.Score = *item.Score
+	}
+	s.commentsMissing = item.Descendants == nil
+	if item.Descendants != nil {
+		s.Descendants = *item.Descendants
 	}
+	s.Deleted = item.Deleted
+	s.Dead = item.Dead
+	s.CommentsURL = item.CommentsURL
+	s.By = item.By
+	if item.Time != 0 {
+		s.HNTime = time.Unix(item.Time, 0)
+	}
+	s.SelfText = item.Text
 	s.missingFieldsLoaded = true
-	return nil
 }
 
-// ShouldIgnore is a filter for story.
-func (s *Story) ShouldIgnore() bool {
-	return s.Type != "story" ||
-		s.Score < ScoreThreshold ||
-		s.Descendants < NumCommentsThreshold ||
-		s.URL == ""
+// Kinds of stories.
+const (
+	KindStory = "story"
+	KindAsk   = "ask"
+	KindShow  = "show"
+	KindJob   = "job"
+)
+
+// kindLabels are the emojis prefixing the messages of the stories of each kind.
+// The titles of Ask HN and Show HN stories already name their kind.
+var kindLabels = map[string]string{
+	KindAsk:  "❓",
+	KindShow: "🚀",
+	KindJob:  "💼 Job:",
+}
+
+// Kind returns the kind of the story. HN items only have a job type, Ask HN and
+// Show HN are stories told apart by their title.
+func (s *Story) Kind() string {
+	switch {
+	case s.Type == "job":
+		return KindJob
+	case s.Type != "story":
+		return s.Type
+	case strings.HasPrefix(s.Title, "Ask HN:"):
+		return KindAsk
+	case strings.HasPrefix(s.Title, "Show HN:"):
+		return KindShow
+	}
+	return KindStory
+}
+
+// Reasons returned by IgnoreReason and sendBlockReason, naming the filter a
+// story fails.
+const (
+	IgnoreDeleted   = "deleted"
+	IgnoreType      = "type"
+	IgnoreScore     = "score"
+	IgnoreComments  = "comments"
+	IgnoreDomain    = "domain"
+	IgnoreRank      = "rank"
+	IgnoreTitle     = "title"
+	IgnoreAge       = "age"
+	IgnoreHotness   = "hotness"
+	IgnoreDuplicate = "duplicate"
+)
+
+// ShouldIgnore is a filter for story, using the thresholds in cfg. Job posts
+// have no score nor comments, so they are only filtered by cfg.PostJobs.
+func (s *Story) ShouldIgnore(cfg *Config) bool {
+	return s.IgnoreReason(cfg) != ""
+}
+
+// IgnoreReason returns the filter of ShouldIgnore the story fails, or an empty
+// string if it passes all of them.
+func (s *Story) IgnoreReason(cfg *Config) string {
+	if s.Deleted || s.Dead {
+		return IgnoreDeleted
+	}
+	if cfg.MaxRank > 0 && s.Rank > cfg.MaxRank {
+		return IgnoreRank
+	}
+	switch s.Kind() {
+	case KindStory, KindAsk, KindShow:
+		switch {
+		case cfg.IsAllowlisted(s.Title):
+			return ""
+		case s.Score < cfg.MinScore:
+			return IgnoreScore
+		case s.Descendants < cfg.MinComments && !s.commentsMissing && !cfg.IsFastTracked(s.Score):
+			return IgnoreComments
+		}
+		return ""
+	case KindJob:
+		if !cfg.PostJobs {
+			return IgnoreType
+		}
+		return ""
+	}
+	return IgnoreType
+}
+
+// hostFromURL returns the lower cased host of storyURL, or an empty string if
+// it can't be parsed.
+func hostFromURL(storyURL string) string {
+	u, err := url.Parse(storyURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// Domain returns the host of the link of the story without "www.", shown by
+// Config.ShowDomain. Self-posts have the host of their comments page when
+// selfPosts is true, e.g. news.ycombinator.com, and none otherwise.
+func (s *Story) Domain(selfPosts bool) string {
+	if s.URL == "" && !selfPosts {
+		return ""
+	}
+	return strings.TrimPrefix(hostFromURL(s.Link()), "www.")
+}
+
+// CommentsLink returns the URL of the comments page of the story.
+func (s *Story) CommentsLink() string {
+	// Only Hacker News stories were saved without it.
+	if s.CommentsURL == "" {
+		return NewsURL(s.ID)
+	}
+	return s.CommentsURL
+}
+
+// AuthorLink returns the link to the profile of the submitter of the story, or
+// an empty string when it's unknown. Only Hacker News profiles are linked.
+func (s *Story) AuthorLink() string {
+	if s.By == "" || (s.Source != SourceHN && s.Source != "") {
+		return ""
+	}
+	return `https://news.ycombinator.com/user?id=` + url.QueryEscape(s.By)
+}
+
+// Link returns the URL of the story, or its comments page for self-posts like
+// Ask HN that have no external URL.
+func (s *Story) Link() string {
+	if s.URL == "" {
+		return s.CommentsLink()
+	}
+	return s.URL
+}
+
+// Text returns the MarkdownV2 text of the message for the story.
+func (s *Story) Text() string {
+	text, err := FormatStory(nil, s)
+	if err != nil {
+		// DefaultTemplate is valid, this only happens if it's broken.
+		return escapeMarkdownV2(s.Title)
+	}
+	return text
+}
+
+// PostedAgo returns how long before now the story was posted, e.g. "3 hours
+// ago", or an empty string when the posting time is unknown.
+func (s *Story) PostedAgo(now time.Time) string {
+	if s.PostedAt.IsZero() {
+		return ""
+	}
+	d := now.Sub(s.PostedAt)
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return fmt.Sprintf("%d minutes ago", int(d/time.Minute))
+	default:
+		return fmt.Sprintf("%d hours ago", int(d/time.Hour))
+	}
+}
+
+// formatDelta returns the change from prev to cur, e.g. " (+30)", or an empty
+// string when there is no change or no previous value.
+func formatDelta(cur, prev int64) string {
+	if prev == 0 || cur == prev {
+		return ""
+	}
+	return fmt.Sprintf(" (%+d)", cur-prev)
+}
+
+// MessageChatID returns the chat the message of the story is posted in, its
+// chat unless it was posted in the FallbackChatID of its chat.
+func (s *Story) MessageChatID() string {
+	if s.PostedChatID != "" {
+		return s.PostedChatID
+	}
+	return s.ChatID
 }
 
 // ToSendMessageRequest will return a new SendMessageRequest object
 func (s *Story) ToSendMessageRequest() SendMessageRequest {
+	markup := s.GetReplyMarkup()
 	return SendMessageRequest{
-		ChatID:      DefaultChatID,
-		Text:        fmt.Sprintf("<b>%s</b>  %s", s.Title, s.URL),
-		ParseMode:   "HTML",
-		ReplyMarkup: s.GetReplyMarkup(),
+		ChatID:          s.MessageChatID(),
+		MessageThreadID: s.MessageThreadID,
+		Text:            s.Text(),
+		ParseMode:       "MarkdownV2",
+		ReplyMarkup:     &markup,
 	}
 }
 
 // ToEditMessageTextRequest will return a new EditMessageTextRequest object
 func (s *Story) ToEditMessageTextRequest() EditMessageTextRequest {
+	markup := s.GetReplyMarkup()
 	return EditMessageTextRequest{
-		ChatID:      DefaultChatID,
+		ChatID:      s.MessageChatID(),
 		MessageID:   s.MessageID,
-		Text:        fmt.Sprintf("<b>%s</b>  %s", s.Title, s.URL),
-		ParseMode:   "HTML",
-		ReplyMarkup: s.GetReplyMarkup(),
+		Text:        s.Text(),
+		ParseMode:   "MarkdownV2",
+		ReplyMarkup: &markup,
 	}
 }
 
-// GetReplyMarkup will return the markup for the story.
+// GetReplyMarkup will return the markup for the story. Self-posts only get the
+// comments button since they have no article to link to.
 func (s *Story) GetReplyMarkup() InlineKeyboardMarkup {
 	var scoreSuffix, commentSuffix string
 	if s.Score > 100 {
@@ -118,132 +510,349 @@ func (s *Story) GetReplyMarkup() InlineKeyboardMarkup {
 	if s.Descendants > 100 {
 		commentSuffix = " " + Hot
 	}
+	var buttons []InlineKeyboardButton
+	if s.URL != "" {
+		buttons = append(buttons, InlineKeyboardButton{
+			Text: fmt.Sprintf("Score: %d+%s", s.Score, scoreSuffix),
+			URL:  s.URL,
+		})
+	}
+	buttons = append(buttons, InlineKeyboardButton{
+		Text: fmt.Sprintf("Comments: %d+%s", s.Descendants, commentSuffix),
+		URL:  s.CommentsLink(),
+	})
 	return InlineKeyboardMarkup{
-		InlineKeyboard: [][]InlineKeyboardButton{
-			{
-				{
-					Text: fmt.Sprintf("Score: %d+%s", s.Score, scoreSuffix),
-					URL:  s.URL,
-				},
-				{
-					Text: fmt.Sprintf("Comments: %d+%s", s.Descendants, commentSuffix),
-					URL:  NewsURL(s.ID),
-				},
-			},
-		},
+		InlineKeyboard: [][]InlineKeyboardButton{buttons},
 	}
 }
 
 // ToDeleteMessageRequest returns a DeleteMessageRequest.
 func (s *Story) ToDeleteMessageRequest() DeleteMessageRequest {
 	return DeleteMessageRequest{
-		ChatID:    DefaultChatID,
+		ChatID:    s.MessageChatID(),
 		MessageID: s.MessageID,
 	}
 }
 
-// EditMessage send a request to edit a message.
-func (s *Story) EditMessage(ctx context.Context) error {
+// Hash returns a hash of the content shown in the message of the story, with
+// the score and the number of comments rounded to their bucket.
+func (s *Story) Hash() string {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s\x00%s\x00%d\x00%d", s.Title, s.URL, s.Score/ScoreBucket, s.Descendants/CommentsBucket)
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// ReplyMarkupHash returns a hash of the buttons of the message of the story,
+// which show the exact score and number of comments.
+func (s *Story) ReplyMarkupHash() string {
+	h := fnv.New64a()
+	for _, row := range s.GetReplyMarkup().InlineKeyboard {
+		for _, button := range row {
+			fmt.Fprintf(h, "%s\x00%s\x00", button.Text, button.URL)
+		}
+	}
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// editReplyMarkup edits only the buttons of the message of the story, when its
+// text is unchanged, and saves markupHash as their hash.
+func (s *Story) editReplyMarkup(ctx context.Context, cfg *Config, markupHash string) error {
+	markup := s.GetReplyMarkup()
+	err := callTelegram(ctx, "editMessageReplyMarkup", EditMessageReplyMarkupRequest{
+		ChatID:      s.MessageChatID(),
+		MessageID:   s.MessageID,
+		ReplyMarkup: &markup,
+	}, nil)
+	if err != nil {
+		if e, ok := asTelegramError(err); !ok || !e.IsNotModified() {
+			return err
+		}
+		log.Debugf(ctx, "buttons of %d not modified", s.ID)
+	}
+	s.MarkupHash = markupHash
+	s.EditCount++
+	s.celebrate(ctx, cfg)
+	return nil
+}
+
+// EditMessage send a request to edit a message. The message is deleted instead
+// when the item was deleted or killed on HN. When the content of the
+// message is unchanged no request is sent, and ErrNotModified is returned
+// unless the story is due to be saved again. Only the buttons are edited when
+// only they changed. EditCount is incremented by each edit sent to Telegram.
+func (s *Story) EditMessage(ctx context.Context, cfg *Config) error {
+	// The message of a combined post shows other stories too.
+	if s.Combined {
+		return errors.WithStack(ErrIgnoredItem)
+	}
+	// Edits scheduled before the story was suppressed.
+	if s.Suppressed {
+		return errors.WithStack(ErrIgnoredItem)
+	}
+	// The story has no message, e.g. its send died after claiming it. The
+	// send takes over the claim once it's stale.
+	if s.MessageID == 0 {
+		log.Warningf(ctx, "%d has no message to edit, sending it", s.ID)
+		if err := sendMessageFunc.Call(ctx, s.ID, s.ChatID, s.Feed, s.Source, s.Rank, 1); err != nil {
+			return errors.WithStack(err)
+		}
+		return errors.WithStack(ErrIgnoredItem)
+	}
+	if cooldown, ok := cfg.EditCooldown(); ok && time.Since(s.PostedAt) < cooldown {
+		log.Debugf(ctx, "%d posted %v ago, not editing it yet", s.ID, time.Since(s.PostedAt))
+		return errors.WithStack(ErrIgnoredItem)
+	}
+	// The delta is from the values shown by the text of the message, the
+	// fresh ones are filled below.
+	prevScore, prevComments := s.shownValues()
 	if !s.missingFieldsLoaded {
 		if err := s.FillMissingFields(ctx); err != nil {
 			return errors.WithStack(err)
 		}
 	}
-	if s.ShouldIgnore() {
+	if s.Deleted || s.Dead {
+		log.Infof(ctx, "%d is deleted or dead, deleting message %d", s.ID, s.MessageID)
+		if err := deleteMessageFunc.Call(ctx, s.ID, s.MessageID, s.ChatID, s.Source); err != nil {
+			return errors.WithStack(err)
+		}
+		return errors.WithStack(ErrItemDeleted)
+	}
+	if reason := s.IgnoreReason(cfg); reason != "" {
+		return errors.WithStack(ignoreError(reason))
+	}
+	// A frozen message isn't edited anymore, but the story is still saved so
+	// the cleanup keeps it while it's polled.
+	if cfg.MaxEdits > 0 && s.EditCount >= cfg.MaxEdits {
+		if time.Since(s.LastSave) >= KeepAliveInterval {
+			return nil
+		}
+		log.Debugf(ctx, "message of %d frozen after %d edits", s.ID, s.EditCount)
 		return errors.WithStack(ErrIgnoredItem)
 	}
 
-	req := s.ToEditMessageTextRequest()
-	jsonBytes, err := json.Marshal(req)
-	if err != nil {
-		return errors.WithStack(err)
+	hash, markupHash := s.Hash(), s.ReplyMarkupHash()
+	// Stories saved without a MarkupHash get one with their next text edit.
+	if hash == s.ContentHash && s.MarkupHash != "" && markupHash != s.MarkupHash {
+		return s.editReplyMarkup(ctx, cfg, markupHash)
+	}
+	if hash == s.ContentHash {
+		// A new milestone must be saved so it's only posted once.
+		if s.celebrate(ctx, cfg) || time.Since(s.LastSave) >= KeepAliveInterval {
+			return nil
+		}
+		return errors.WithStack(ErrNotModified)
 	}
+	s.ContentHash, s.MarkupHash = hash, markupHash
+	s.PrevScore, s.PrevComments = prevScore, prevComments
 
-	resp, err := myHTTPClient(ctx).Post(TelegramAPI("editMessageText"), "application/json", bytes.NewBuffer(jsonBytes))
+	req := s.ToEditMessageTextRequest()
+	text, err := FormatStory(cfg, s)
 	if err != nil {
-		return errors.WithStack(err)
+		return err
+	}
+	req.Text = truncateForTelegram(text)
+	req.DisableWebPagePreview = cfg.DisablePreview
+	method, payload := "editMessageText", interface{}(req)
+	if s.HasPhoto {
+		// Photo messages have a caption instead of a text, which is shorter.
+		method, payload = "editMessageCaption", EditMessageCaptionRequest{
+			ChatID:      req.ChatID,
+			MessageID:   req.MessageID,
+			Caption:     truncateMarkdownV2(text, MaxCaptionLength),
+			ParseMode:   req.ParseMode,
+			ReplyMarkup: req.ReplyMarkup,
+		}
+	}
+	if err := callTelegram(ctx, method, payload, nil); err != nil {
+		// The message already shows the content, e.g. when an earlier edit
+		// was saved with a different hash.
+		if e, ok := asTelegramError(err); !ok || !e.IsNotModified() {
+			return err
+		}
+		log.Debugf(ctx, "message of %d not modified", s.ID)
 	}
-	defer resp.Body.Close()
-	io.Copy(ioutil.Discard, resp.Body)
+	s.ShownScore, s.ShownComments = s.Score, s.Descendants
+	s.EditCount++
+	s.celebrate(ctx, cfg)
 	return nil
 }
 
 // InDatastore checks if the story is already in datastore.
 func (s *Story) InDatastore(ctx context.Context) bool {
 	log.Infof(ctx, "calling InDatastore")
-	key := GetKey(ctx, s.ID)
+	key := GetKey(ctx, s.Source, s.ChatID, s.ID)
 	q := datastore.NewQuery("Story").Filter("__key__ =", key).KeysOnly()
 	keys, _ := q.GetAll(ctx, nil)
 	return len(keys) != 0
 }
 
-// SendMessage send a request to send a new message.
-func (s *Story) SendMessage(ctx context.Context) error {
+// SendMessage send a request to send a new message. The caller makes sure the
+// story isn't already posted.
+func (s *Story) SendMessage(ctx context.Context, cfg *Config) error {
+	if s.Suppressed {
+		log.Infof(ctx, "ignoring suppressed %d", s.ID)
+		return ErrIgnoredItem
+	}
 	if !s.missingFieldsLoaded {
 		if err := s.FillMissingFields(ctx); err != nil {
 			return errors.WithStack(err)
 		}
 	}
-
-	if s.ShouldIgnore() {
-		return ErrIgnoredItem
-	} else if s.InDatastore(ctx) {
-		return errors.WithStack(fmt.Errorf("story already posted: %#v", s))
+	if err := s.checkSendable(ctx, cfg); err != nil {
+		return err
 	}
+	s.MessageThreadID = cfg.MessageThreadID
 	req := s.ToSendMessageRequest()
-	jsonBytes, err := json.Marshal(req)
+	text, err := FormatStory(cfg, s)
 	if err != nil {
-		return errors.WithStack(err)
+		return err
 	}
-
-	resp, err := myHTTPClient(ctx).Post(TelegramAPI("sendMessage"), "application/json", bytes.NewBuffer(jsonBytes))
-	if err != nil {
-		return errors.WithStack(err)
+	text = truncateForTelegram(text)
+	req.Text = text
+	req.DisableWebPagePreview = cfg.DisablePreview
+	_, quiet := cfg.QuietUntil(time.Now())
+	req.DisableNotification = cfg.IsSilent(s.Score) || quiet
+	if cfg.UsePhotoWhenImage && s.URL != "" {
+		if photo, ok := fetchOGImage(ctx, s.URL); ok {
+			messageID, err := s.sendPhoto(ctx, photo, text, req.DisableNotification)
+			if err == nil {
+				s.MessageID, s.HasPhoto = messageID, true
+				s.posted(cfg)
+				return nil
+			}
+			// Telegram may fail to fetch the image, send a text instead.
+			log.Warningf(ctx, "sending %s as photo of %d: %v", photo, s.ID, err)
+		}
+	}
+	messageID, err := postMessage(ctx, req)
+	if e, ok := asTelegramError(err); ok && e.IsForbidden() && cfg.FallbackChatID != "" && cfg.FallbackChatID != s.ChatID {
+		// The bot was kicked or blocked, don't lose the story.
+		log.Warningf(ctx, "sending %d to fallback %s: %v", s.ID, cfg.FallbackChatID, e)
+		// The topic belongs to the primary chat.
+		req.ChatID, req.MessageThreadID = cfg.FallbackChatID, 0
+		messageID, err = postMessage(ctx, req)
+		if err == nil {
+			s.PostedChatID, s.MessageThreadID = cfg.FallbackChatID, 0
+		}
 	}
-	defer resp.Body.Close()
-
-	var response SendMessageResponse
-
-	err = json.NewDecoder(resp.Body).Decode(&response)
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	s.MessageID = response.Result.MessageID
+	s.MessageID = messageID
+	s.posted(cfg)
 	return nil
 }
 
-// DeleteMessage delete a message from telegram Channel and from channel.
-func (s *Story) DeleteMessage(ctx context.Context) error {
-	req := s.ToDeleteMessageRequest()
-	jsonBytes, err := json.Marshal(req)
+// checkSendable returns ErrIgnoredItem, or an error refining it, if the story
+// mustn't be posted in the chat of cfg, or a QuietHoursError or a PostCapError
+// if it must wait. The missing fields of the story must be loaded.
+func (s *Story) checkSendable(ctx context.Context, cfg *Config) error {
+	reason, err := s.sendBlockReason(ctx, cfg, time.Now())
 	if err != nil {
-		return errors.WithStack(err)
+		return err
+	}
+	if reason != "" {
+		return ignoreError(reason)
 	}
+	if end, quiet := cfg.QuietUntil(time.Now()); quiet && cfg.QuietDefer {
+		return &QuietHoursError{
+			ChatID:     s.ChatID,
+			RetryAfter: time.Until(end) + spreadDelay(s.ID, QuietSpread),
+		}
+	}
+	return s.checkPostCap(ctx, cfg, time.Now())
+}
 
-	resp, err := myHTTPClient(ctx).Post(TelegramAPI("deleteMessage"), "application/json", bytes.NewBuffer(jsonBytes))
-	if err != nil {
-		return errors.WithStack(err)
+// sendBlockReason returns the filter of checkSendable the story fails at now,
+// the ones of IgnoreReason included, or an empty string if it may be posted in
+// the chat of cfg. The missing fields of the story must be loaded.
+func (s *Story) sendBlockReason(ctx context.Context, cfg *Config, now time.Time) (string, error) {
+	if reason := s.IgnoreReason(cfg); reason != "" {
+		return reason, nil
+	}
+	if s.URL != "" && cfg.IsBlacklisted(hostFromURL(s.URL)) {
+		log.Infof(ctx, "ignoring %d from blacklisted %s", s.ID, s.URL)
+		return IgnoreDomain, nil
+	}
+	if cfg.IsJunkTitle(s.Title) {
+		log.Infof(ctx, "ignoring %d of junk title %q", s.ID, s.Title)
+		return IgnoreTitle, nil
+	}
+	if minAge, ok := cfg.MinAge(); ok && !s.HNTime.IsZero() && now.Sub(s.HNTime) < minAge {
+		// A later poll posts it once it's old enough.
+		log.Infof(ctx, "ignoring %d submitted %v ago", s.ID, now.Sub(s.HNTime))
+		return IgnoreAge, nil
+	}
+	if h, cold := s.isCold(cfg, now); cold {
+		log.Infof(ctx, "ignoring %d of hotness %.2f", s.ID, h)
+		return IgnoreHotness, nil
 	}
-	defer resp.Body.Close()
+	if cfg.DedupeByURL && s.URL != "" {
+		duplicate, err := s.isDuplicate(ctx)
+		if err != nil {
+			return "", err
+		}
+		if duplicate {
+			log.Infof(ctx, "ignoring %d, %s was already posted", s.ID, s.URL)
+			return IgnoreDuplicate, nil
+		}
+	}
+	return "", nil
+}
 
-	var response DeleteMessageResponse
+// posted updates the story once its message is sent.
+func (s *Story) posted(cfg *Config) {
+	if s.PostedAt.IsZero() {
+		s.PostedAt = time.Now()
+	}
+	s.ContentHash, s.MarkupHash = s.Hash(), s.ReplyMarkupHash()
+	s.ShownScore, s.ShownComments = s.Score, s.Descendants
+	// Only the milestones crossed after the story is posted are notified.
+	s.LastMilestone = reachedMilestone(cfg.CommentMilestones, s.Descendants)
+	s.LastReaction = reachedMilestone(cfg.ScoreMilestones, s.Score)
+}
 
-	err = json.NewDecoder(resp.Body).Decode(&response)
-	if err != nil {
-		return errors.WithStack(err)
+// shownValues returns the score and the comments shown by the text of the
+// message, as of its send or last text edit. The saves without a text edit,
+// e.g. of only the buttons, don't change them. Stories saved before they were
+// tracked fall back to their saved values.
+func (s *Story) shownValues() (int64, int64) {
+	if s.ShownScore == 0 && s.ShownComments == 0 {
+		return s.Score, s.Descendants
 	}
+	return s.ShownScore, s.ShownComments
+}
 
-	if !response.OK {
-		if !response.ShouldIgnoreError() {
-			return errors.WithStack(fmt.Errorf("%#v", response))
+// DeleteMessage delete a message from telegram Channel and from channel. The
+// message of a combined post is kept for the other stories it shows, only the
+// story is deleted from datastore.
+func (s *Story) DeleteMessage(ctx context.Context) error {
+	if s.MessageID == 0 {
+		log.Warningf(ctx, "%d has no message to delete", s.ID)
+	} else if s.Combined {
+		log.Infof(ctx, "keeping combined message %d of %d", s.MessageID, s.ID)
+	} else if err := callTelegram(ctx, "deleteMessage", s.ToDeleteMessageRequest(), nil); err != nil {
+		e, ok := asTelegramError(err)
+		if !ok || !e.IsUndeletable() {
+			return err
 		}
-		log.Warningf(ctx, "ignoring %#v", response)
+		log.Warningf(ctx, "ignoring %v", e)
 	}
 
-	key := GetKey(ctx, s.ID)
+	// The suppressed stories stay until their cleanup, which has no message
+	// to delete, so they aren't posted again.
+	if s.Suppressed && s.MessageID != 0 {
+		log.Infof(ctx, "%d (messageID: %d) suppressed", s.ID, s.MessageID)
+		return nil
+	}
+	key := GetKey(ctx, s.Source, s.ChatID, s.ID)
+	if err := deleteScoreSamples(ctx, key); err != nil {
+		return err
+	}
 	if err := datastore.Delete(ctx, key); err != nil {
 		return errors.WithStack(err)
 	}
+	countEvent(ctx, CounterDeletes, 1)
 	log.Infof(ctx, "%d (messageID: %d) deleted", s.ID, s.MessageID)
 	return nil
 }
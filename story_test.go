@@ -0,0 +1,425 @@
+package bots
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestStoryKind(t *testing.T) {
+	for _, c := range []struct {
+		typ, title string
+		want       string
+		// label is expected at the start of the message.
+		label string
+	}{
+		{"story", "A story", KindStory, "*A story*"},
+		{"story", "Ask HN: What's up?", KindAsk, "❓ *Ask HN: What's up?*"},
+		{"story", "Show HN: A bot", KindShow, "🚀 *Show HN: A bot*"},
+		{"story", "Tell HN: Ask HN: is a prefix", KindStory, "*Tell HN: Ask HN: is a prefix*"},
+		{"story", "ask hn: lower case", KindStory, "*ask hn: lower case*"},
+		{"job", "Acme (YC S17) is hiring", KindJob, "💼 Job: *Acme \\(YC S17\\) is hiring*"},
+		{"job", "Show HN: not a show", KindJob, "💼 Job: *Show HN: not a show*"},
+		{"poll", "A poll", "poll", "*A poll*"},
+	} {
+		s := &Story{ID: 1, Type: c.typ, Title: c.title}
+		if got := s.Kind(); got != c.want {
+			t.Errorf("Kind() of %s %q = %q, want %q", c.typ, c.title, got, c.want)
+		}
+		text, err := FormatStory(nil, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(text, c.label) {
+			t.Errorf("FormatStory() of %s %q = %q, want the prefix %q", c.typ, c.title, text, c.label)
+		}
+	}
+}
+
+func TestEditMessageDeletedItem(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	for _, c := range []struct {
+		name, item string
+		want       error
+		// edits is the number of expected Telegram edits. Deleted items have
+		// their message deleted by a task instead.
+		edits int
+	}{
+		{"alive", `{"id":1,"type":"story","title":"A story","score":100,"descendants":10}`, nil, 1},
+		{"dead", `{"id":1,"type":"story","title":"A story","score":100,"descendants":10,"dead":true}`, ErrItemDeleted, 0},
+		{"deleted", `{"id":1,"deleted":true,"type":"story"}`, ErrItemDeleted, 0},
+		{"purged", `null`, ErrItemDeleted, 0},
+	} {
+		server := newFakeServer(func(w http.ResponseWriter, r *http.Request) {
+			if r.Host == "hacker-news.firebaseio.com" {
+				io.WriteString(w, c.item)
+				return
+			}
+			io.WriteString(w, `{"ok":true,"result":{"message_id":42}}`)
+		})
+		s := &Story{ID: 1, ChatID: "@chat", MessageID: 42}
+		err := s.EditMessage(ctx, &Config{})
+		server.Close()
+		if errors.Cause(err) != c.want {
+			t.Errorf("%s: EditMessage() = %v, want %v", c.name, err, c.want)
+		}
+		if got := len(server.TelegramRequests()); got != c.edits {
+			t.Errorf("%s: %d Telegram requests, want %d", c.name, got, c.edits)
+		}
+	}
+}
+
+func TestSendMessageChatID(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	server := newFakeServer(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"ok":true,"result":{"message_id":42}}`)
+	})
+	defer server.Close()
+	for i, chatID := range []string{"@yahnc", "-1001234567890", "123456789"} {
+		s := &Story{ID: 1, Type: "story", Title: "A story", Score: 100, Descendants: 10, ChatID: chatID, missingFieldsLoaded: true}
+		if err := s.SendMessage(ctx, &Config{ChatID: chatID}); err != nil {
+			t.Fatal(err)
+		}
+		var payload struct {
+			ChatID json.RawMessage `json:"chat_id"`
+		}
+		if err := json.Unmarshal(server.TelegramRequests()[i].Body, &payload); err != nil {
+			t.Fatal(err)
+		}
+		// Telegram takes numeric IDs as strings too.
+		if want := strconv.Quote(chatID); string(payload.ChatID) != want {
+			t.Errorf("chat_id of %s = %s, want %s", chatID, payload.ChatID, want)
+		}
+	}
+}
+
+func TestZeroMessageID(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	server := newFakeServer(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"ok":true,"result":true}`)
+	})
+	defer server.Close()
+
+	// The edit of a story without message sends it instead.
+	s := &Story{ID: 1, Type: "story", Title: "A story", Score: 100, ChatID: "@chat", missingFieldsLoaded: true}
+	if err := s.EditMessage(ctx, &Config{}); errors.Cause(err) != ErrIgnoredItem {
+		t.Errorf("EditMessage() without message = %v, want %v", err, ErrIgnoredItem)
+	}
+	if reqs := server.TelegramRequests(); len(reqs) != 0 {
+		t.Errorf("EditMessage() without message sent %v", reqs)
+	}
+
+	for _, c := range []struct {
+		messageID int64
+		calls     int
+	}{
+		{0, 0},
+		{42, 1},
+	} {
+		server.reset()
+		s := &Story{ID: 1, ChatID: "@chat", Source: SourceHN, MessageID: c.messageID}
+		key := GetKey(ctx, s.Source, s.ChatID, s.ID)
+		putStory(ctx, t, key, s, time.Now())
+		if err := s.DeleteMessage(ctx); err != nil {
+			t.Errorf("DeleteMessage() of message %d = %v", c.messageID, err)
+		}
+		if reqs := server.TelegramRequests(); len(reqs) != c.calls {
+			t.Errorf("DeleteMessage() of message %d sent %d requests, want %d", c.messageID, len(reqs), c.calls)
+		}
+		// The story is deleted either way.
+		if err := datastore.Get(ctx, key, &Story{}); err != datastore.ErrNoSuchEntity {
+			t.Errorf("story of message %d loaded with %v, want it deleted", c.messageID, err)
+		}
+	}
+}
+
+func TestSendMessageFallback(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	for _, c := range []struct {
+		name, fallback string
+		// primary and inFallback are the responses in each chat.
+		primary, inFallback string
+		wantChats           []string
+		wantPosted          string
+		wantErr             bool
+	}{
+		{"forbidden", "@fallback", forbiddenResponse, sentResponse, []string{"@chat", "@fallback"}, "@fallback", false},
+		{"sent", "@fallback", sentResponse, sentResponse, []string{"@chat"}, "", false},
+		{"no fallback", "", forbiddenResponse, sentResponse, []string{"@chat"}, "", true},
+		{"bad request", "@fallback", badRequestResponse, sentResponse, []string{"@chat"}, "", true},
+		{"fallback forbidden", "@fallback", forbiddenResponse, forbiddenResponse, []string{"@chat", "@fallback"}, "", true},
+		{"fallback to itself", "@chat", forbiddenResponse, sentResponse, []string{"@chat"}, "", true},
+	} {
+		server := newFakeServer(func(w http.ResponseWriter, r *http.Request) {
+			var req SendMessageRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			if req.ChatID == "@fallback" {
+				io.WriteString(w, c.inFallback)
+				return
+			}
+			io.WriteString(w, c.primary)
+		})
+		s := &Story{ID: 1, Type: "story", Title: "A story", Score: 100, ChatID: "@chat", missingFieldsLoaded: true}
+		err := s.SendMessage(ctx, &Config{ChatID: "@chat", FallbackChatID: c.fallback, MessageThreadID: 7})
+		server.Close()
+		if (err != nil) != c.wantErr {
+			t.Errorf("%s: SendMessage() = %v, want an error %v", c.name, err, c.wantErr)
+		}
+		var chats []string
+		for _, r := range server.TelegramRequests() {
+			var req SendMessageRequest
+			json.Unmarshal(r.Body, &req)
+			chats = append(chats, req.ChatID)
+			// The topic belongs to the primary chat.
+			if req.ChatID == "@fallback" && req.MessageThreadID != 0 {
+				t.Errorf("%s: sent to the topic %d of the fallback", c.name, req.MessageThreadID)
+			}
+		}
+		if strings.Join(chats, ",") != strings.Join(c.wantChats, ",") {
+			t.Errorf("%s: sent to %v, want %v", c.name, chats, c.wantChats)
+		}
+		if s.PostedChatID != c.wantPosted {
+			t.Errorf("%s: PostedChatID = %q, want %q", c.name, s.PostedChatID, c.wantPosted)
+		}
+		// Its edits and deletes go to the chat it was posted in.
+		want := c.wantPosted
+		if want == "" {
+			want = "@chat"
+		}
+		if got := s.ToEditMessageTextRequest().ChatID; !c.wantErr && got != want {
+			t.Errorf("%s: edits go to %q, want %q", c.name, got, want)
+		}
+	}
+}
+
+// Canned responses of sendMessage.
+const (
+	sentResponse       = `{"ok":true,"result":{"message_id":42}}`
+	forbiddenResponse  = `{"ok":false,"error_code":403,"description":"Forbidden: bot was kicked from the channel chat"}`
+	badRequestResponse = `{"ok":false,"error_code":400,"description":"Bad Request: can't parse entities"}`
+)
+
+func TestEditMessageReplyMarkup(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	shown := Story{ID: 1, Type: "story", Title: "A story", URL: "https://example.com/", Score: 100, Descendants: 10}
+	for _, c := range []struct {
+		name string
+		// edit changes the story shown by the message.
+		edit       func(s *Story)
+		noMarkup   bool
+		wantMethod string
+		want       error
+	}{
+		{"unchanged", func(s *Story) {}, false, "", ErrNotModified},
+		{"buttons", func(s *Story) { s.Score = 104 }, false, "editMessageReplyMarkup", nil},
+		{"comment buttons", func(s *Story) { s.Descendants = 11 }, false, "editMessageReplyMarkup", nil},
+		{"score bucket", func(s *Story) { s.Score = 110 }, false, "editMessageText", nil},
+		{"title", func(s *Story) { s.Title = "A new title" }, false, "editMessageText", nil},
+		// Stories saved without a MarkupHash get one with their next text
+		// edit.
+		{"buttons without hash", func(s *Story) { s.Score = 104 }, true, "", ErrNotModified},
+	} {
+		server := newFakeServer(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, `{"ok":true,"result":true}`)
+		})
+		s := shown
+		s.ChatID, s.MessageID, s.LastSave, s.missingFieldsLoaded = "@chat", 42, time.Now(), true
+		s.ContentHash, s.MarkupHash = shown.Hash(), shown.ReplyMarkupHash()
+		if c.noMarkup {
+			s.MarkupHash = ""
+		}
+		c.edit(&s)
+		err := s.EditMessage(ctx, &Config{})
+		server.Close()
+		if errors.Cause(err) != c.want {
+			t.Errorf("%s: EditMessage() = %v, want %v", c.name, err, c.want)
+		}
+		var methods []string
+		for _, r := range server.TelegramRequests() {
+			methods = append(methods, r.Method())
+		}
+		if strings.Join(methods, ",") != c.wantMethod {
+			t.Errorf("%s: called %v, want %q", c.name, methods, c.wantMethod)
+		}
+		if c.want == nil && (s.ContentHash != s.Hash() || s.MarkupHash != s.ReplyMarkupHash()) {
+			t.Errorf("%s: hashes of the edit not saved", c.name)
+		}
+	}
+}
+
+func TestEditMessageCooldown(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	server := newFakeServer(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"ok":true,"result":{"message_id":42}}`)
+	})
+	defer server.Close()
+	for _, c := range []struct {
+		name     string
+		cooldown int64
+		age      time.Duration
+		want     error
+		edits    int
+	}{
+		{"no cooldown", 0, 0, nil, 1},
+		{"just posted", 300, 0, ErrIgnoredItem, 0},
+		{"before the end", 300, 299 * time.Second, ErrIgnoredItem, 0},
+		{"after the end", 300, 301 * time.Second, nil, 1},
+		{"long ago", 300, time.Hour, nil, 1},
+	} {
+		server.reset()
+		s := &Story{ID: 1, Type: "story", Title: "A story", Score: 100, ChatID: "@chat", MessageID: 42, PostedAt: time.Now().Add(-c.age), missingFieldsLoaded: true}
+		err := s.EditMessage(ctx, &Config{EditCooldownSeconds: c.cooldown})
+		if errors.Cause(err) != c.want {
+			t.Errorf("%s: EditMessage() = %v, want %v", c.name, err, c.want)
+		}
+		if got := len(server.TelegramRequests()); got != c.edits {
+			t.Errorf("%s: %d Telegram requests, want %d", c.name, got, c.edits)
+		}
+	}
+}
+
+func TestEditMessageMaxEdits(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	server := newFakeServer(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"ok":true,"result":true}`)
+	})
+	defer server.Close()
+	cfg := &Config{MaxEdits: 3}
+	s := &Story{ID: 1, Type: "story", Title: "A story", URL: "https://example.com/", Score: 100, ChatID: "@chat", MessageID: 42, LastSave: time.Now(), missingFieldsLoaded: true}
+	s.ContentHash, s.MarkupHash = s.Hash(), s.ReplyMarkupHash()
+	for i, c := range []struct {
+		// edit changes the story shown by the message.
+		edit       func(s *Story)
+		wantMethod string
+		want       error
+	}{
+		{func(s *Story) { s.Score = 120 }, "editMessageText", nil},
+		{func(s *Story) { s.Score = 121 }, "editMessageReplyMarkup", nil},
+		{func(s *Story) { s.Score = 130 }, "editMessageText", nil},
+		// The N+1th edit is skipped.
+		{func(s *Story) { s.Score = 140 }, "", ErrIgnoredItem},
+		{func(s *Story) { s.Title = "A new title" }, "", ErrIgnoredItem},
+		// The frozen story is still saved once it's due, without edit.
+		{func(s *Story) { s.LastSave = time.Now().Add(-KeepAliveInterval) }, "", nil},
+	} {
+		server.reset()
+		c.edit(s)
+		err := s.EditMessage(ctx, cfg)
+		if errors.Cause(err) != c.want {
+			t.Errorf("edit %d: EditMessage() = %v, want %v", i+1, err, c.want)
+		}
+		var methods []string
+		for _, r := range server.TelegramRequests() {
+			methods = append(methods, r.Method())
+		}
+		if strings.Join(methods, ",") != c.wantMethod {
+			t.Errorf("edit %d: called %v, want %q", i+1, methods, c.wantMethod)
+		}
+		if s.EditCount > cfg.MaxEdits {
+			t.Errorf("edit %d: EditCount = %d, want at most %d", i+1, s.EditCount, cfg.MaxEdits)
+		}
+	}
+	if s.EditCount != cfg.MaxEdits {
+		t.Errorf("EditCount = %d, want %d", s.EditCount, cfg.MaxEdits)
+	}
+}
+
+func TestEditMessageDelta(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	server := newFakeServer(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"ok":true,"result":true}`)
+	})
+	defer server.Close()
+
+	// An edit of the story at score and comments, last saved age ago, in a
+	// chat with maxEdits.
+	type edit struct {
+		score, comments int64
+		age             time.Duration
+		maxEdits        int64
+		wantMethod      string
+	}
+	for _, c := range []struct {
+		name string
+		// setup changes the story as sent.
+		setup func(s *Story)
+		edits []edit
+	}{
+		{"text", func(s *Story) {}, []edit{{115, 12, 0, 0, "editMessageText"}}},
+		// The buttons show the exact values, the text still shows the
+		// ones of the send.
+		{"buttons", func(s *Story) {}, []edit{
+			{104, 11, 0, 0, "editMessageReplyMarkup"},
+			{115, 12, 0, 0, "editMessageText"},
+		}},
+		// The keep-alive saves, e.g. of a story without a MarkupHash whose
+		// values stay in their buckets, don't change what the text shows.
+		{"keep-alive", func(s *Story) { s.MarkupHash = "" }, []edit{
+			{104, 11, KeepAliveInterval, 0, ""},
+			{115, 12, 0, 0, "editMessageText"},
+		}},
+		// Nor the saves of a frozen message, until MaxEdits is raised.
+		{"frozen", func(s *Story) { s.EditCount = 1 }, []edit{
+			{104, 11, KeepAliveInterval, 1, ""},
+			{115, 12, 0, 0, "editMessageText"},
+		}},
+	} {
+		key := GetKey(ctx, SourceHN, "@chat", 1)
+		s := &Story{ID: 1, Type: "story", Title: "A story", URL: "https://example.com/", Score: 100, Descendants: 10, ChatID: "@chat", MessageID: 42}
+		s.posted(&Config{})
+		c.setup(s)
+		putStory(ctx, t, key, s, time.Now())
+		for i, e := range c.edits {
+			server.reset()
+			story, err := NewFromDatastore(ctx, SourceHN, "@chat", 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			story.Score, story.Descendants, story.missingFieldsLoaded = e.score, e.comments, true
+			story.LastSave = time.Now().Add(-e.age)
+			if err := story.EditMessage(ctx, &Config{MaxEdits: e.maxEdits}); err != nil {
+				t.Fatalf("%s: edit %d: EditMessage() = %v", c.name, i+1, err)
+			}
+			var methods []string
+			for _, r := range server.TelegramRequests() {
+				methods = append(methods, r.Method())
+			}
+			if strings.Join(methods, ",") != e.wantMethod {
+				t.Errorf("%s: edit %d: called %v, want %q", c.name, i+1, methods, e.wantMethod)
+			}
+			putStory(ctx, t, key, &story, time.Now())
+			s = &story
+		}
+		// The delta is from the values shown by the text before the last
+		// edit.
+		if s.PrevScore != 100 || s.PrevComments != 10 {
+			t.Errorf("%s: delta from %d points and %d comments, want 100 and 10", c.name, s.PrevScore, s.PrevComments)
+		}
+		reqs := server.TelegramRequests()
+		if len(reqs) != 1 {
+			t.Fatalf("%s: %d Telegram requests, want 1", c.name, len(reqs))
+		}
+		var req EditMessageTextRequest
+		if err := json.Unmarshal(reqs[0].Body, &req); err != nil {
+			t.Fatal(err)
+		}
+		if want := `\(\+15\)`; !strings.Contains(req.Text, want) {
+			t.Errorf("%s: text %q, want the delta %q", c.name, req.Text, want)
+		}
+	}
+}
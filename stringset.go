@@ -0,0 +1,26 @@
+package bots
+
+// StringSet is a string set type.
+type StringSet map[string]struct{}
+
+// Add add a string to the set. Return false if the string already exists in the set.
+func (set StringSet) Add(s string) bool {
+	if _, ok := set[s]; ok {
+		return false
+	}
+	set[s] = v
+	return true
+}
+
+// AddAll add a slice of strings to the set.
+func (set StringSet) AddAll(xs []string) {
+	for _, s := range xs {
+		set[s] = v
+	}
+}
+
+// Contains returns true if the string is in the set.
+func (set StringSet) Contains(s string) bool {
+	_, ok := set[s]
+	return ok
+}
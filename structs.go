@@ -1,19 +1,31 @@
 package bots
 
-import (
-	"errors"
-	"strings"
-)
+import "errors"
 
 // ErrIgnoredItem is returned when the story should be ignored.
 var ErrIgnoredItem = errors.New("item ignored")
 
 // SendMessageRequest is a struct that maps to a sendMessage request.
 type SendMessageRequest struct {
-	ChatID      string               `json:"chat_id"`
-	Text        string               `json:"text"`
-	ParseMode   string               `json:"parse_mode,omitempty"`
-	ReplyMarkup InlineKeyboardMarkup `json:"reply_markup,omitempty"`
+	ChatID                string                `json:"chat_id"`
+	MessageThreadID       int64                 `json:"message_thread_id,omitempty"`
+	Text                  string                `json:"text"`
+	ParseMode             string                `json:"parse_mode,omitempty"`
+	DisableWebPagePreview bool                  `json:"disable_web_page_preview,omitempty"`
+	DisableNotification   bool                  `json:"disable_notification,omitempty"`
+	ReplyToMessageID      int64                 `json:"reply_to_message_id,omitempty"`
+	ReplyMarkup           *InlineKeyboardMarkup `json:"reply_markup,omitempty"`
+}
+
+// SendPhotoRequest is the request to sendPhoto method.
+type SendPhotoRequest struct {
+	ChatID              string                `json:"chat_id"`
+	MessageThreadID     int64                 `json:"message_thread_id,omitempty"`
+	Photo               string                `json:"photo"`
+	Caption             string                `json:"caption,omitempty"`
+	ParseMode           string                `json:"parse_mode,omitempty"`
+	DisableNotification bool                  `json:"disable_notification,omitempty"`
+	ReplyMarkup         *InlineKeyboardMarkup `json:"reply_markup,omitempty"`
 }
 
 // InlineKeyboardMarkup type.
@@ -27,47 +39,93 @@ type InlineKeyboardButton struct {
 	URL  string `json:"url,omitempty"`
 }
 
-// SendMessageResponse is the response from sendMessage request.
-type SendMessageResponse struct {
-	OK     bool   `json:"ok"`
-	Result Result `json:"result"`
-}
-
-// Result is a submessage in SendMessageResponse. We only care the MessageID for now.
+// Result is the result of sendMessage. We only care the MessageID for now.
 type Result struct {
 	MessageID int64 `json:"message_id"`
 }
 
 // EditMessageTextRequest is the request to editMessageText method.
 type EditMessageTextRequest struct {
-	ChatID      string               `json:"chat_id"`
-	MessageID   int64                `json:"message_id"`
-	Text        string               `json:"text"`
-	ParseMode   string               `json:"parse_mode,omitempty"`
-	ReplyMarkup InlineKeyboardMarkup `json:"reply_markup,omitempty"`
+	ChatID                string                `json:"chat_id"`
+	MessageID             int64                 `json:"message_id"`
+	Text                  string                `json:"text"`
+	ParseMode             string                `json:"parse_mode,omitempty"`
+	DisableWebPagePreview bool                  `json:"disable_web_page_preview,omitempty"`
+	ReplyMarkup           *InlineKeyboardMarkup `json:"reply_markup,omitempty"`
 }
 
-// DeleteMessageRequest is the request to deleteMessage method.
-type DeleteMessageRequest struct {
+// EditMessageCaptionRequest is the request to editMessageCaption method, editing
+// the caption of a photo message.
+type EditMessageCaptionRequest struct {
+	ChatID      string                `json:"chat_id"`
+	MessageID   int64                 `json:"message_id"`
+	Caption     string                `json:"caption"`
+	ParseMode   string                `json:"parse_mode,omitempty"`
+	ReplyMarkup *InlineKeyboardMarkup `json:"reply_markup,omitempty"`
+}
+
+// EditMessageReplyMarkupRequest is the request to editMessageReplyMarkup
+// method, editing only the buttons of a message.
+type EditMessageReplyMarkupRequest struct {
+	ChatID      string                `json:"chat_id"`
+	MessageID   int64                 `json:"message_id"`
+	ReplyMarkup *InlineKeyboardMarkup `json:"reply_markup,omitempty"`
+}
+
+// ResponseParameters is the parameters of a failed Telegram API response.
+type ResponseParameters struct {
+	RetryAfter int64 `json:"retry_after"`
+}
+
+// Update is an incoming update sent to the webhook.
+type Update struct {
+	UpdateID int64    `json:"update_id"`
+	Message  *Message `json:"message"`
+}
+
+// Message is a Telegram message. We only care about the fields needed to run
+// the bot commands.
+type Message struct {
+	MessageID int64  `json:"message_id"`
+	Chat      Chat   `json:"chat"`
+	Text      string `json:"text"`
+}
+
+// Chat is the chat a Message belongs to.
+type Chat struct {
+	ID   int64  `json:"id"`
+	Type string `json:"type"`
+}
+
+// PinChatMessageRequest is the request to pinChatMessage method.
+type PinChatMessageRequest struct {
+	ChatID              string `json:"chat_id"`
+	MessageID           int64  `json:"message_id"`
+	DisableNotification bool   `json:"disable_notification,omitempty"`
+}
+
+// UnpinChatMessageRequest is the request to unpinChatMessage method.
+type UnpinChatMessageRequest struct {
 	ChatID    string `json:"chat_id"`
 	MessageID int64  `json:"message_id"`
 }
 
-// DeleteMessageResponse is the response to deleteMessage method.
-type DeleteMessageResponse struct {
-	OK          bool   `json:"ok"`
-	ErrorCode   int64  `json:"error_code"`
-	Description string `json:"description"`
+// SetMessageReactionRequest is the request to setMessageReaction method.
+type SetMessageReactionRequest struct {
+	ChatID    string         `json:"chat_id"`
+	MessageID int64          `json:"message_id"`
+	Reaction  []ReactionType `json:"reaction"`
 }
 
-// ShouldIgnoreError return true if the message contains an error but should be ignored.
-func (r *DeleteMessageResponse) ShouldIgnoreError() bool {
-	return (r.ErrorCode == 400 &&
-		// Someone manually deleted the message from the channel
-		(strings.Contains(r.Description, "message to delete not found") ||
-			// Story was on top 30 list for > 24 hours but Telegram API only allow
-			// deleting messages that were posted in <48 hours.
-			// It should be fine to just ignore this error, and leave these stories in
-			// channel forever.
-			strings.Contains(r.Description, "message can't be deleted")))
+// ReactionType is a reaction of SetMessageReactionRequest. We only send emoji
+// reactions.
+type ReactionType struct {
+	Type  string `json:"type"`
+	Emoji string `json:"emoji"`
+}
+
+// DeleteMessageRequest is the request to deleteMessage method.
+type DeleteMessageRequest struct {
+	ChatID    string `json:"chat_id"`
+	MessageID int64  `json:"message_id"`
 }
@@ -0,0 +1,289 @@
+package bots
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/appengine/log"
+)
+
+// TelegramRetries is the number of retries of a Telegram API call failed with a
+// network error or a 5xx response.
+const TelegramRetries = 3
+
+// TelegramRetryBackoff is the delay before the first retry. It's doubled for
+// each following retry.
+const TelegramRetryBackoff = 500 * time.Millisecond
+
+// TelegramRetryTimeout caps the total time spent on retrying a Telegram API
+// call, so it stays well under DefaultTimeout.
+const TelegramRetryTimeout = 30 * time.Second
+
+// DefaultRetryAfter is the delay before retrying a rate limited Telegram API
+// call, when Telegram doesn't say how long to wait.
+const DefaultRetryAfter = 30 * time.Second
+
+// ErrNoBotKey is returned by the Telegram API calls when no bot token is set.
+var ErrNoBotKey = errors.New("BOT_KEY is not set, set it in the env_variables of app.yaml or with /admin/token")
+
+// RateLimitError is returned when Telegram rejects a call with HTTP 429.
+type RateLimitError struct {
+	Method     string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%s rate limited, retry after %v", e.Method, e.RetryAfter)
+}
+
+// Cause returns ErrRateLimited, so rate limits are told apart with errors.Cause
+// like the other errors.
+func (e *RateLimitError) Cause() error {
+	return ErrRateLimited
+}
+
+// telegramResult is the envelope of the responses of all Telegram API methods.
+type telegramResult struct {
+	OK          bool            `json:"ok"`
+	Result      json.RawMessage `json:"result"`
+	ErrorCode   int64           `json:"error_code"`
+	Description string          `json:"description"`
+}
+
+// TelegramError is returned when Telegram answers a call with ok false, which
+// may come with any HTTP status, 200 included.
+type TelegramError struct {
+	Method      string
+	Code        int64
+	Description string
+}
+
+func (e *TelegramError) Error() string {
+	return fmt.Sprintf("%s failed with %d: %s", e.Method, e.Code, e.Description)
+}
+
+// IsNotModified return true if the message was left unchanged because the edit
+// has the same content.
+func (e *TelegramError) IsNotModified() bool {
+	return e.Code == 400 && strings.Contains(e.Description, "message is not modified")
+}
+
+// IsMessageNotFound return true if the message to (un)pin or edit doesn't exist
+// anymore. A chat not found isn't, see IsChatGone.
+func (e *TelegramError) IsMessageNotFound() bool {
+	return e.Code == 400 &&
+		(strings.Contains(e.Description, "message to pin not found") ||
+			strings.Contains(e.Description, "message to unpin not found") ||
+			strings.Contains(e.Description, "message to edit not found") ||
+			strings.Contains(e.Description, "message not found"))
+}
+
+// IsReactionUnavailable return true if the reaction can't be set on the
+// message, e.g. the chat doesn't permit it.
+func (e *TelegramError) IsReactionUnavailable() bool {
+	return e.Code == 400 && strings.Contains(e.Description, "REACTION")
+}
+
+// IsChatGone return true if the chat can't be posted in anymore, e.g. it was
+// deleted or the bot was removed from it.
+func (e *TelegramError) IsChatGone() bool {
+	return e.IsForbidden() || (e.Code == 400 && strings.Contains(e.Description, "chat not found"))
+}
+
+// IsForbidden return true if the bot may not post in the chat, e.g. it was
+// kicked from it or blocked.
+func (e *TelegramError) IsForbidden() bool {
+	return e.Code == 403
+}
+
+// IsUndeletable return true if the message to delete is gone or can't be
+// deleted, and the error should be ignored.
+func (e *TelegramError) IsUndeletable() bool {
+	return (e.Code == 400 &&
+		// Someone manually deleted the message from the channel
+		(strings.Contains(e.Description, "message to delete not found") ||
+			// Story was on top 30 list for > 24 hours but Telegram API only allow
+			// deleting messages that were posted in <48 hours.
+			// It should be fine to just ignore this error, and leave these stories in
+			// channel forever.
+			strings.Contains(e.Description, "message can't be deleted")))
+}
+
+// asTelegramError returns the TelegramError causing err, if any.
+func asTelegramError(err error) (*TelegramError, bool) {
+	e, ok := errors.Cause(err).(*TelegramError)
+	return e, ok
+}
+
+// parseRetryAfter returns the delay requested by a HTTP 429 response, read
+// from parameters.retry_after of the body or from the Retry-After header. The
+// body is left readable.
+func parseRetryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err == nil {
+		var response struct {
+			Parameters ResponseParameters `json:"parameters"`
+		}
+		if json.Unmarshal(body, &response) == nil && response.Parameters.RetryAfter > 0 {
+			return time.Duration(response.Parameters.RetryAfter) * time.Second, true
+		}
+	}
+
+	if seconds, err := strconv.ParseInt(resp.Header.Get("Retry-After"), 10, 64); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	return 0, false
+}
+
+// DryRunMessageID is the ID of the messages sent in dry runs.
+const DryRunMessageID = -1
+
+// dryRunKey is the context key of withDryRun.
+type dryRunKey struct{}
+
+// withDryRun returns ctx whose Telegram requests are only logged when dryRun is
+// true, see Config.DryRun.
+func withDryRun(ctx context.Context, dryRun bool) context.Context {
+	return context.WithValue(ctx, dryRunKey{}, dryRun)
+}
+
+// isDryRun returns true if the Telegram requests of ctx are only logged.
+func isDryRun(ctx context.Context) bool {
+	dryRun, _ := ctx.Value(dryRunKey{}).(bool)
+	return dryRun
+}
+
+// dryRunResponse returns the response of the Telegram requests of dry runs,
+// which all succeed and send messages of DryRunMessageID.
+func dryRunResponse() *http.Response {
+	body := fmt.Sprintf(`{"ok":true,"result":{"message_id":%d}}`, DryRunMessageID)
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+	}
+}
+
+// doTelegramRequest posts payload as JSON to the given Telegram API method.
+// Network errors and 5xx responses are retried with exponential backoff, other
+// HTTP 429 responses are returned as a RateLimitError so the caller can retry
+// later, other responses are returned to the caller as is. In dry runs payload
+// is only logged. The outcome of each call, after its retries, is counted by
+// countTelegramOutcome.
+func doTelegramRequest(ctx context.Context, method string, payload interface{}) (*http.Response, error) {
+	jsonBytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if isDryRun(ctx) {
+		log.Infof(ctx, "dry run %s: %s", method, jsonBytes)
+		return dryRunResponse(), nil
+	}
+	if botToken(ctx) == "" {
+		return nil, errors.WithStack(ErrNoBotKey)
+	}
+
+	deadline := time.Now().Add(TelegramRetryTimeout)
+	backoff := TelegramRetryBackoff
+	for attempt := 1; ; attempt++ {
+		req, err := newRequest(http.MethodPost, TelegramAPI(ctx, method), bytes.NewReader(jsonBytes))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := newHTTPClient(ctx).Do(req)
+		if err == nil && resp.StatusCode == http.StatusTooManyRequests {
+			retryAfter, ok := parseRetryAfter(resp)
+			if !ok {
+				retryAfter = DefaultRetryAfter
+			}
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			countTelegramOutcome(ctx, OutcomeRateLimited)
+			return nil, errors.WithStack(&RateLimitError{Method: method, RetryAfter: retryAfter})
+		}
+		if err == nil && resp.StatusCode < http.StatusInternalServerError {
+			if resp.StatusCode < http.StatusBadRequest {
+				countTelegramOutcome(ctx, OutcomeOK)
+			} else {
+				countTelegramOutcome(ctx, OutcomeClientError)
+			}
+			return resp, nil
+		}
+		outcome := OutcomeNetworkError
+		if err == nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			err = fmt.Errorf("%s: %s", method, resp.Status)
+			outcome = OutcomeServerError
+		}
+
+		if attempt > TelegramRetries || time.Now().Add(backoff).After(deadline) || ctx.Err() != nil {
+			countTelegramOutcome(ctx, outcome)
+			return nil, errors.Wrapf(err, "in doTelegramRequest() after %d attempts", attempt)
+		}
+		log.Warningf(ctx, "retrying %s in %v: %v", method, backoff, err)
+		select {
+		case <-ctx.Done():
+			countTelegramOutcome(ctx, outcome)
+			return nil, errors.WithStack(ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// callTelegram calls the given Telegram API method with payload, and decodes
+// the result of the response into result unless it's nil. A TelegramError is
+// returned when the response isn't ok.
+func callTelegram(ctx context.Context, method string, payload, result interface{}) error {
+	resp, err := doTelegramRequest(ctx, method, payload)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	var response telegramResult
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return errors.Wrapf(err, "in callTelegram() decoding the %s response of %s", resp.Status, method)
+	}
+	if !response.OK {
+		return errors.WithStack(&TelegramError{
+			Method:      method,
+			Code:        response.ErrorCode,
+			Description: response.Description,
+		})
+	}
+	if result != nil && len(response.Result) != 0 {
+		if err := json.Unmarshal(response.Result, result); err != nil {
+			return errors.Wrapf(err, "in callTelegram() decoding the result of %s", method)
+		}
+	}
+	return nil
+}
+
+// postMessage sends req with the sendMessage method and returns the ID of the
+// new message.
+func postMessage(ctx context.Context, req SendMessageRequest) (int64, error) {
+	var result Result
+	if err := callTelegram(ctx, "sendMessage", req, &result); err != nil {
+		return 0, err
+	}
+	return result.MessageID, nil
+}
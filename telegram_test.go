@@ -0,0 +1,127 @@
+package bots
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTelegramErrorIsNotModified(t *testing.T) {
+	for _, c := range []struct {
+		code        int64
+		description string
+		want        bool
+	}{
+		{400, "Bad Request: message is not modified: specified new message content and reply markup are exactly the same as a current content and reply markup of the message", true},
+		{400, "Bad Request: message to edit not found", false},
+		{403, "Forbidden: message is not modified", false},
+		{429, "Too Many Requests: retry after 5", false},
+	} {
+		e := &TelegramError{Method: "editMessageText", Code: c.code, Description: c.description}
+		if got := e.IsNotModified(); got != c.want {
+			t.Errorf("IsNotModified() of %d %q = %v, want %v", c.code, c.description, got, c.want)
+		}
+	}
+}
+
+func TestEditMessageNotModified(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	for _, c := range []struct {
+		name, body string
+		// wantErr is true if the edit fails with a TelegramError.
+		wantErr bool
+	}{
+		{"edited", `{"ok":true,"result":{"message_id":42}}`, false},
+		{"not modified", `{"ok":false,"error_code":400,"description":"Bad Request: message is not modified: specified new message content and reply markup are exactly the same as a current content and reply markup of the message"}`, false},
+		{"not found", `{"ok":false,"error_code":400,"description":"Bad Request: message to edit not found"}`, true},
+	} {
+		server := newFakeServer(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			io.WriteString(w, c.body)
+		})
+		s := &Story{ID: 1, Type: "story", Title: "A story", Score: 100, ChatID: "@chat", MessageID: 42, ContentHash: "old", missingFieldsLoaded: true}
+		err := s.EditMessage(ctx, &Config{})
+		server.Close()
+		if _, ok := asTelegramError(err); ok != c.wantErr || (!c.wantErr && err != nil) {
+			t.Errorf("%s: EditMessage() = %v, want a TelegramError %v", c.name, err, c.wantErr)
+		}
+		if reqs := server.TelegramRequests(); len(reqs) != 1 || reqs[0].Method() != "editMessageText" {
+			t.Errorf("%s: Telegram requests %v, want one editMessageText", c.name, reqs)
+		}
+		if !c.wantErr && s.EditCount != 1 {
+			t.Errorf("%s: EditCount = %d, want 1", c.name, s.EditCount)
+		}
+	}
+}
+
+func TestCallTelegram(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	for _, c := range []struct {
+		name   string
+		status int
+		body   string
+		// want is the expected TelegramError, nil if the call succeeds.
+		want *TelegramError
+		// wantID is the expected message ID of a successful call.
+		wantID int64
+	}{
+		{"ok", 200, `{"ok":true,"result":{"message_id":42}}`, nil, 42},
+		{"not ok with 200", 200, `{"ok":false,"error_code":400,"description":"Bad Request: can't parse entities"}`, &TelegramError{"sendMessage", 400, "Bad Request: can't parse entities"}, 0},
+		{"chat not found", 400, `{"ok":false,"error_code":400,"description":"Bad Request: chat not found"}`, &TelegramError{"sendMessage", 400, "Bad Request: chat not found"}, 0},
+		{"blocked", 403, `{"ok":false,"error_code":403,"description":"Forbidden: bot was blocked by the user"}`, &TelegramError{"sendMessage", 403, "Forbidden: bot was blocked by the user"}, 0},
+		{"kicked", 403, `{"ok":false,"error_code":403,"description":"Forbidden: bot was kicked from the channel chat"}`, &TelegramError{"sendMessage", 403, "Forbidden: bot was kicked from the channel chat"}, 0},
+		{"unauthorized", 401, `{"ok":false,"error_code":401,"description":"Unauthorized"}`, &TelegramError{"sendMessage", 401, "Unauthorized"}, 0},
+	} {
+		server := newFakeServer(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(c.status)
+			io.WriteString(w, c.body)
+		})
+		id, err := postMessage(ctx, SendMessageRequest{ChatID: "@chat", Text: "text"})
+		server.Close()
+		if c.want == nil {
+			if err != nil || id != c.wantID {
+				t.Errorf("%s: postMessage() = %d, %v, want %d", c.name, id, err, c.wantID)
+			}
+			continue
+		}
+		if e, ok := asTelegramError(err); !ok || *e != *c.want {
+			t.Errorf("%s: postMessage() = %v, want %v", c.name, err, c.want)
+		}
+		if !strings.Contains(err.Error(), c.want.Description) {
+			t.Errorf("%s: error %q doesn't show the description", c.name, err)
+		}
+	}
+}
+
+func TestCallTelegramMalformed(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	for _, body := range []string{"", "<html>Bad Gateway</html>", `{"ok":true,"result":"not a message"}`} {
+		server := newFakeServer(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, body)
+		})
+		_, err := postMessage(ctx, SendMessageRequest{ChatID: "@chat", Text: "text"})
+		server.Close()
+		if _, ok := asTelegramError(err); err == nil || ok {
+			t.Errorf("postMessage() answered %q = %v, want a decoding error", body, err)
+		}
+	}
+}
+
+func TestCallTelegramRateLimited(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	server := newFakeServer(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		io.WriteString(w, `{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 7","parameters":{"retry_after":7}}`)
+	})
+	defer server.Close()
+	_, err := postMessage(ctx, SendMessageRequest{ChatID: "@chat", Text: "text"})
+	if e, ok := asRateLimitError(err); !ok || e.RetryAfter != 7*time.Second {
+		t.Errorf("postMessage() = %v, want a RateLimitError after 7s", err)
+	}
+}
@@ -0,0 +1,103 @@
+package bots
+
+import (
+	"bytes"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultTemplate is the layout of the messages of the chats without a
+// MessageTemplate. Templates are executed with the *Story and produce
+// MarkdownV2, so story fields must be escaped.
+const DefaultTemplate = `{{with label .Kind}}{{escape .}} {{end}}*{{escape .Title}}*{{with domain .}} {{escape (printf "(%s)" .)}}{{end}}  {{escape .Link}}
+{{- if and (eq .Kind "ask") .SelfText}}
+
+{{selfText .SelfText}}
+{{- end}}
+{{- if ne .Kind "job"}}
+{{escape (printf "%s %d%s · 💬 %d%s" (badge .Score) .Score (delta .Score .PrevScore) .Descendants (delta .Descendants .PrevComments))}}
+{{- if .By}}{{escape " · by "}}
+{{- if .AuthorLink}}[{{escape .By}}]({{escapeURL .AuthorLink}}){{else}}{{escape .By}}{{end}}
+{{- end}}
+{{- end}}`
+
+// templateFuncs are the functions available in message templates.
+var templateFuncs = template.FuncMap{
+	"escape":    escapeMarkdownV2,
+	"escapeURL": escapeMarkdownV2URL,
+	"label":     func(kind string) string { return kindLabels[kind] },
+	"delta":     formatDelta,
+	"selfText": func(text string) string {
+		return htmlToTelegramLimit(text, SelfTextLength)
+	},
+	// badge and domain are replaced by FormatStory to follow the config of
+	// the chat.
+	"badge":  func(score int64) string { return scoreBadge(score, DefaultBadgeRules) },
+	"domain": func(s *Story) string { return "" },
+}
+
+var defaultTemplate = template.Must(parseTemplate(DefaultTemplate))
+
+// parseTemplate parses a message template.
+func parseTemplate(tmpl string) (*template.Template, error) {
+	t, err := template.New("message").Funcs(templateFuncs).Parse(tmpl)
+	return t, errors.WithStack(err)
+}
+
+// FormatStory returns the text of the message of s laid out by the
+// MessageTemplate of cfg, or by DefaultTemplate when it's empty. Scores are
+// badged by the ScoreBadges of cfg, or by DefaultBadgeRules when there is none.
+// A nil cfg formats s with the defaults.
+func FormatStory(cfg *Config, s *Story) (string, error) {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	t := defaultTemplate
+	if cfg.MessageTemplate != "" {
+		var err error
+		if t, err = parseTemplate(cfg.MessageTemplate); err != nil {
+			return "", err
+		}
+	}
+	if len(cfg.ScoreBadges) != 0 || cfg.ShowDomain {
+		// The shared defaultTemplate must not be changed.
+		var err error
+		if t, err = t.Clone(); err != nil {
+			return "", errors.WithStack(err)
+		}
+		badges := cfg.ScoreBadges
+		if len(badges) == 0 {
+			badges = DefaultBadgeRules
+		}
+		showDomain, selfPosts := cfg.ShowDomain, cfg.ShowSelfPostDomain
+		t.Funcs(template.FuncMap{
+			"badge": func(score int64) string { return scoreBadge(score, badges) },
+			"domain": func(s *Story) string {
+				if !showDomain {
+					return ""
+				}
+				return s.Domain(selfPosts)
+			},
+		})
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, s); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return buf.String(), nil
+}
+
+// validateTemplate returns an error if tmpl can't format a story.
+func validateTemplate(tmpl string) error {
+	sample := Story{
+		ID:          1,
+		URL:         "https://example.com/",
+		Title:       "Title",
+		Score:       100,
+		Descendants: 10,
+		PrevScore:   90,
+	}
+	_, err := FormatStory(&Config{MessageTemplate: tmpl, ShowDomain: true}, &sample)
+	return err
+}
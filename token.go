@@ -0,0 +1,182 @@
+package bots
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/fnv"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// BotTokenTTL is how long an instance caches the bot tokens, so the tokens set
+// by /admin/token reach every instance within it.
+const BotTokenTTL = time.Minute
+
+// BotToken is the bot tokens set by /admin/token, separated by commas. It
+// overrides BOT_KEYS and BOT_KEY so the tokens can be rotated without a deploy.
+type BotToken struct {
+	Token     string `datastore:",noindex"`
+	UpdatedAt time.Time
+}
+
+// GetBotTokenKey get a datastore key for the bot token.
+func GetBotTokenKey(ctx context.Context) *datastore.Key {
+	return datastore.NewKey(ctx, "BotToken", "bot", 0, nil)
+}
+
+// botTokenCache is the bot tokens cached by the instance.
+var botTokenCache struct {
+	sync.Mutex
+	tokens []string
+	expiry time.Time
+}
+
+// envBotTokens returns the tokens of BOT_KEYS, separated by commas, or else of
+// BOT_KEY.
+func envBotTokens() []string {
+	if tokens := parseBotTokens(os.Getenv("BOT_KEYS")); len(tokens) != 0 {
+		return tokens
+	}
+	return parseBotTokens(os.Getenv("BOT_KEY"))
+}
+
+// parseBotTokens splits the tokens of s separated by commas.
+func parseBotTokens(s string) []string {
+	var tokens []string
+	for _, token := range strings.Split(s, ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// botTokens returns the tokens of the bots, the ones saved in datastore if any
+// or else envBotTokens. They're cached for BotTokenTTL. The first one is the
+// default bot.
+func botTokens(ctx context.Context) []string {
+	botTokenCache.Lock()
+	defer botTokenCache.Unlock()
+	if time.Now().Before(botTokenCache.expiry) {
+		return botTokenCache.tokens
+	}
+
+	var saved BotToken
+	err := datastore.Get(ctx, GetBotTokenKey(ctx), &saved)
+	switch {
+	case err == nil && saved.Token != "":
+		botTokenCache.tokens = parseBotTokens(saved.Token)
+	case err == nil || err == datastore.ErrNoSuchEntity:
+		botTokenCache.tokens = envBotTokens()
+	case len(botTokenCache.tokens) == 0:
+		// Datastore is unavailable, try again on the next call.
+		loge(ctx, errors.WithStack(err))
+		return envBotTokens()
+	default:
+		// Keep the tokens cached until datastore is back.
+		loge(ctx, errors.WithStack(err))
+	}
+	botTokenCache.expiry = time.Now().Add(BotTokenTTL)
+	return botTokenCache.tokens
+}
+
+// botIDOf returns the ID of the bot of token, the number before its colon. It
+// doesn't change when the token is regenerated. Zero is returned for invalid
+// tokens.
+func botIDOf(token string) int64 {
+	i := strings.Index(token, ":")
+	if i < 0 {
+		return 0
+	}
+	id, err := strconv.ParseInt(token[:i], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return id
+}
+
+// botIDKey is the context key of withBot.
+type botIDKey struct{}
+
+// withBot returns ctx whose Telegram requests are sent by the bot of the given
+// ID, see Story.BotID. Zero is the default bot.
+func withBot(ctx context.Context, botID int64) context.Context {
+	return context.WithValue(ctx, botIDKey{}, botID)
+}
+
+// botToken returns the token of the bot of ctx, see withBot. The default bot is
+// used when ctx has none, or when its bot is no longer configured. An empty
+// string is returned when no token is set.
+func botToken(ctx context.Context) string {
+	tokens := botTokens(ctx)
+	if len(tokens) == 0 {
+		return ""
+	}
+	if botID, _ := ctx.Value(botIDKey{}).(int64); botID != 0 {
+		for _, token := range tokens {
+			if botIDOf(token) == botID {
+				return token
+			}
+		}
+		log.Warningf(ctx, "bot %d is no longer configured, using the default bot", botID)
+	}
+	return tokens[0]
+}
+
+// chooseBot returns the ID of the bot sending the story of the given ID. Stories
+// are spread over the bots by ID, so each bot has its share of the rate limit.
+func chooseBot(ctx context.Context, itemID int64) int64 {
+	tokens := botTokens(ctx)
+	if len(tokens) == 0 {
+		return 0
+	}
+	h := fnv.New32a()
+	binary.Write(h, binary.LittleEndian, itemID)
+	return botIDOf(tokens[h.Sum32()%uint32(len(tokens))])
+}
+
+// botTokenHandler saves the bot tokens given by the bot_token parameter of a
+// POST, separated by commas. An empty parameter deletes the saved tokens,
+// falling back to BOT_KEYS or BOT_KEY.
+func botTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	ctx := appengine.NewContext(r)
+
+	token := r.FormValue("bot_token")
+	key := GetBotTokenKey(ctx)
+	var err error
+	if token == "" {
+		err = datastore.Delete(ctx, key)
+		if err == datastore.ErrNoSuchEntity {
+			err = nil
+		}
+	} else {
+		_, err = datastore.Put(ctx, key, &BotToken{Token: token, UpdatedAt: time.Now()})
+	}
+	if err != nil {
+		loge(ctx, errors.WithStack(err))
+		http.Error(w, "datastore error", http.StatusInternalServerError)
+		return
+	}
+
+	// Other instances pick the token up when their cache expires.
+	botTokenCache.Lock()
+	botTokenCache.expiry = time.Time{}
+	botTokenCache.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,108 @@
+package bots
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+)
+
+// SecretTokenHeader is the header Telegram sets to the secret_token given to
+// setWebhook.
+const SecretTokenHeader = "X-Telegram-Bot-Api-Secret-Token"
+
+// command handles a bot command and returns the text to reply with.
+type command func(ctx context.Context, msg *Message, args []string) (string, error)
+
+var commands = map[string]command{
+	"/ping":  pingCommand,
+	"/score": scoreCommand,
+}
+
+// CommandTimeout is the timeout of the outgoing requests of a command, so the
+// webhook answers before Telegram gives up and sends the update again.
+const CommandTimeout = 10 * time.Second
+
+func webhookHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(appengine.NewContext(r), CommandTimeout)
+	defer cancel()
+
+	secret := os.Getenv("WEBHOOK_SECRET")
+	if secret == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get(SecretTokenHeader)), []byte(secret)) != 1 {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	var update Update
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	// Telegram retries the update until it gets a 2xx response, so failures
+	// to reply are only logged.
+	if update.Message == nil {
+		return
+	}
+	if err := dispatchCommand(ctx, update.Message); err != nil {
+		loge(ctx, err)
+	}
+}
+
+// dispatchCommand runs the command in msg, if any, and replies with its result.
+func dispatchCommand(ctx context.Context, msg *Message) error {
+	fields := strings.Fields(msg.Text)
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], "/") {
+		return nil
+	}
+	// Commands in groups may be suffixed with the bot username, e.g. /ping@bot.
+	name := strings.SplitN(fields[0], "@", 2)[0]
+	cmd, ok := commands[name]
+	if !ok {
+		log.Debugf(ctx, "unknown command %q", name)
+		return nil
+	}
+
+	text, err := cmd(ctx, msg, fields[1:])
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return reply(ctx, msg, text)
+}
+
+// reply sends text to the chat of msg.
+func reply(ctx context.Context, msg *Message, text string) error {
+	req := SendMessageRequest{
+		ChatID: strconv.FormatInt(msg.Chat.ID, 10),
+		Text:   text,
+	}
+	return callTelegram(ctx, "sendMessage", req, nil)
+}
+
+func pingCommand(ctx context.Context, msg *Message, args []string) (string, error) {
+	return "pong", nil
+}
+
+func scoreCommand(ctx context.Context, msg *Message, args []string) (string, error) {
+	if len(args) != 1 {
+		return "usage: /score <id>", nil
+	}
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return "usage: /score <id>", nil
+	}
+	story := Story{ID: id, Source: SourceHN}
+	if err := story.FillMissingFields(ctx); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return fmt.Sprintf("%s\nScore: %d, Comments: %d\n%s", story.Title, story.Score, story.Descendants, NewsURL(id)), nil
+}